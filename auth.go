@@ -0,0 +1,172 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP AUTH mechanisms for SMTPserver.AuthMethod
+const (
+	AuthPlain    = "PLAIN"
+	AuthLogin    = "LOGIN"
+	AuthCRAMMD5  = "CRAM-MD5"
+	AuthXOAUTH2  = "XOAUTH2"
+	AuthExternal = "EXTERNAL"
+)
+
+// TokenProvider return OAuth2 access token for XOAUTH2, it called before every
+// authentication and must refresh expired token
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenProviderFunc function as TokenProvider
+type TokenProviderFunc func(ctx context.Context) (string, error)
+
+// Token call f(ctx)
+func (f TokenProviderFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// authFunc return smtp.Auth for mechanisms advertised by server in EHLO AUTH extension
+type authFunc func(ctx context.Context, mechanisms []string) (smtp.Auth, error)
+
+// authFunc return authFunc for server or nil if server has not credentials.
+// certificate is true if TLS client certificate is used.
+func (s *SMTPserver) authFunc(certificate bool) authFunc {
+	if s.Username == "" && s.TokenProvider == nil && s.AuthMethod == "" && !certificate {
+		return nil
+	}
+	return func(ctx context.Context, mechanisms []string) (smtp.Auth, error) {
+		method := strings.ToUpper(s.AuthMethod)
+		if method == "" {
+			method = s.chooseAuth(mechanisms, certificate)
+		}
+		switch method {
+		case "":
+			return nil, nil
+		case AuthPlain:
+			return smtp.PlainAuth("", s.Username, s.Password, s.Host), nil
+		case AuthLogin:
+			return &loginAuth{username: s.Username, password: s.Password, host: s.Host}, nil
+		case AuthCRAMMD5:
+			return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+		case AuthXOAUTH2:
+			if s.TokenProvider == nil {
+				return nil, errors.New("XOAUTH2 token provider is not set")
+			}
+			token, err := s.TokenProvider.Token(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("get XOAUTH2 token: %w", err)
+			}
+			return &xoauth2Auth{username: s.Username, token: token}, nil
+		case AuthExternal:
+			return &externalAuth{authzid: s.Username}, nil
+		}
+		return nil, fmt.Errorf("unsupported AUTH mechanism %s", method)
+	}
+}
+
+// chooseAuth return XOAUTH2 if has token provider, EXTERNAL if client certificate used and server support it,
+// else PLAIN, LOGIN or CRAM-MD5 by server support, default PLAIN.
+// Empty if only client certificate used without SASL.
+func (s *SMTPserver) chooseAuth(mechanisms []string, certificate bool) string {
+	if s.TokenProvider != nil {
+		return AuthXOAUTH2
+	}
+	supported := map[string]bool{}
+	for _, m := range mechanisms {
+		supported[strings.ToUpper(m)] = true
+	}
+	if certificate && supported[AuthExternal] {
+		return AuthExternal
+	}
+	if s.Username == "" {
+		return ""
+	}
+	for _, m := range []string{AuthPlain, AuthLogin, AuthCRAMMD5} {
+		if supported[m] {
+			return m
+		}
+	}
+	return AuthPlain
+}
+
+// loginAuth LOGIN mechanism, like smtp.PlainAuth sends credentials only over TLS or to localhost
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	challenge := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(challenge, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(challenge, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// xoauth2Auth XOAUTH2 mechanism, sends token only over TLS or to localhost
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return AuthXOAUTH2, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answer empty response to error challenge, then server return error reply
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// externalAuth EXTERNAL mechanism, server authenticate client by TLS certificate
+type externalAuth struct {
+	authzid string
+}
+
+func (a *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if a.authzid == "" {
+		return AuthExternal, nil, nil
+	}
+	return AuthExternal, []byte(a.authzid), nil
+}
+
+// Next answer empty authorization identity if it was not sent in initial response
+func (a *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,76 @@
+package smtpSender
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+)
+
+func TestChooseAuth(t *testing.T) {
+	token := TokenProviderFunc(func(ctx context.Context) (string, error) {
+		return "token", nil
+	})
+	tests := []struct {
+		server      SMTPserver
+		mechanisms  []string
+		certificate bool
+		method      string
+	}{
+		{SMTPserver{Username: "user"}, []string{"PLAIN", "LOGIN", "CRAM-MD5"}, false, AuthPlain},
+		{SMTPserver{Username: "user"}, []string{"login", "cram-md5"}, false, AuthLogin},
+		{SMTPserver{Username: "user"}, []string{"CRAM-MD5"}, false, AuthCRAMMD5},
+		{SMTPserver{Username: "user", TokenProvider: token}, []string{"PLAIN", "XOAUTH2"}, false, AuthXOAUTH2},
+		{SMTPserver{Username: "user"}, nil, false, AuthPlain},
+		{SMTPserver{Username: "user"}, []string{"PLAIN", "EXTERNAL"}, true, AuthExternal},
+		{SMTPserver{}, []string{"PLAIN"}, true, ""},
+	}
+	for i, test := range tests {
+		if m := test.server.chooseAuth(test.mechanisms, test.certificate); m != test.method {
+			t.Errorf("test %d mechanisms %v choose '%s', want '%s'", i, test.mechanisms, m, test.method)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	a := &loginAuth{username: "user", password: "secret", host: "smtp.domain.tld"}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "smtp.domain.tld"}); err == nil {
+		t.Error("LOGIN started over unencrypted connection")
+	}
+	method, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.domain.tld", TLS: true})
+	if err != nil || method != AuthLogin || resp != nil {
+		t.Fatalf("start return %s %q %v", method, resp, err)
+	}
+	for challenge, want := range map[string]string{"Username:": "user", "Password:": "secret"} {
+		if resp, err = a.Next([]byte(challenge), true); err != nil || string(resp) != want {
+			t.Errorf("challenge %s response %q %v", challenge, resp, err)
+		}
+	}
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	a := &xoauth2Auth{username: "user@domain.tld", token: "token"}
+	method, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.domain.tld", TLS: true})
+	if err != nil || method != AuthXOAUTH2 {
+		t.Fatalf("start return %s %v", method, err)
+	}
+	if string(resp) != "user=user@domain.tld\x01auth=Bearer token\x01\x01" {
+		t.Errorf("wrong initial response %q", resp)
+	}
+	if resp, err = a.Next([]byte(`{"status":"401"}`), true); err != nil || len(resp) != 0 {
+		t.Errorf("error challenge response %q %v", resp, err)
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	a := &externalAuth{}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "localhost"}); err == nil {
+		t.Error("EXTERNAL started over unencrypted connection")
+	}
+	method, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.domain.tld", TLS: true})
+	if err != nil || method != AuthExternal || resp != nil {
+		t.Fatalf("start return %s %q %v", method, resp, err)
+	}
+	if resp, err = a.Next(nil, true); err != nil || resp == nil || len(resp) != 0 {
+		t.Errorf("empty challenge response %q %v", resp, err)
+	}
+}
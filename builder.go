@@ -34,6 +34,15 @@ const (
 	boundaryAlternativeEnd   = "--" + boundaryAlternative + "--\r\n"
 )
 
+// Body types for Builder.SetBodyType
+const (
+	// Body8BitMIME text parts are sent as 8bit if server supports 8BITMIME
+	Body8BitMIME = "8BITMIME"
+	// BodyBinaryMIME text parts and files are sent as binary if server supports BINARYMIME and CHUNKING,
+	// else as Body8BitMIME
+	BodyBinaryMIME = "BINARYMIME"
+)
+
 // Builder helper for create email
 type Builder struct {
 	From             string
@@ -41,6 +50,8 @@ type Builder struct {
 	Subject          string
 	subjectFunc      func(io.Writer) error
 	replyTo          string
+	cc               []string
+	bcc              []string
 	headers          []string
 	mimeHeader       textproto.MIMEHeader
 	htmlPart         []byte
@@ -52,6 +63,9 @@ type Builder struct {
 	htmlRelatedFiles []*os.File
 	attachments      []*os.File
 	dkim             builderDKIM
+	dsn              *DSN
+	bodyType         string
+	body             string
 }
 
 type builderDKIM struct {
@@ -84,6 +98,38 @@ func (b *Builder) SetDKIM(domain, selector string, privateKey []byte) *Builder {
 	return b
 }
 
+// SetDSNReturn set DSN RET parameter DSNReturnFull or DSNReturnHeaders
+func (b *Builder) SetDSNReturn(ret string) *Builder {
+	b.dsnRequest().Return = ret
+	return b
+}
+
+// SetDSNEnvelopeID set DSN ENVID parameter returned in notification
+func (b *Builder) SetDSNEnvelopeID(id string) *Builder {
+	b.dsnRequest().EnvelopeID = id
+	return b
+}
+
+// SetDSNNotify set DSN NOTIFY parameter for every recipient
+func (b *Builder) SetDSNNotify(notify ...string) *Builder {
+	b.dsnRequest().Notify = notify
+	return b
+}
+
+func (b *Builder) dsnRequest() *DSN {
+	if b.dsn == nil {
+		b.dsn = &DSN{}
+	}
+	return b.dsn
+}
+
+// SetBodyType allow Body8BitMIME or BodyBinaryMIME parts if server supports them,
+// else text parts are quoted-printable and files are base64
+func (b *Builder) SetBodyType(body string) *Builder {
+	b.bodyType = body
+	return b
+}
+
 // SetFrom email sender
 func (b *Builder) SetFrom(name, email string) *Builder {
 	from := mail.Address{Name: name, Address: email}
@@ -98,6 +144,20 @@ func (b *Builder) SetTo(name, email string) *Builder {
 	return b
 }
 
+// AddCc add Cc recipient
+func (b *Builder) AddCc(name, email string) *Builder {
+	cc := mail.Address{Name: name, Address: email}
+	b.cc = append(b.cc, cc.String())
+	return b
+}
+
+// AddBcc add Bcc recipient, it is only added to envelope and never written to headers
+func (b *Builder) AddBcc(name, email string) *Builder {
+	bcc := mail.Address{Name: name, Address: email}
+	b.bcc = append(b.bcc, bcc.String())
+	return b
+}
+
 // SetSubject set email subject
 func (b *Builder) SetSubject(subject string) *Builder {
 	b.Subject = subject
@@ -216,11 +276,97 @@ func (b *Builder) Email(id string, resultFunc func(Result)) *Email {
 	email.ID = id
 	email.From = b.From
 	email.To = b.To
+	email.Recipients = append(append(email.Recipients, b.cc...), b.bcc...)
 	email.ResultFunc = resultFunc
 	email.WriteCloser = b.emailWriteCloser
+	email.Size = b.estimateSize()
+	if b.bodyType == Body8BitMIME || b.bodyType == BodyBinaryMIME {
+		email.body = b.bodyType
+		email.bodyWriter = b.bodyWriteCloser
+	}
+	if b.dsn != nil {
+		dsn := *b.dsn
+		dsn.Notify = append([]string(nil), b.dsn.Notify...)
+		email.DSN = &dsn
+	}
 	return email
 }
 
+// estimateSize return lower estimate of rendered email size by parts and encoded files,
+// parts from writer functions are not counted
+func (b *Builder) estimateSize() int {
+	size := len(b.textPart) + len(b.htmlPart) + len(b.ampPart)
+	for _, files := range [][]*os.File{b.htmlRelatedFiles, b.attachments} {
+		for _, f := range files {
+			info, err := f.Stat()
+			if err != nil {
+				continue
+			}
+			if b.bodyType == BodyBinaryMIME {
+				size += int(info.Size())
+				continue
+			}
+			encoded := int(info.Size()+2) / 3 * 4
+			size += encoded + encoded/76*2
+		}
+	}
+	return size
+}
+
+// bodyWriteCloser render email with 8bit or binary parts allowed by body
+func (b Builder) bodyWriteCloser(w io.WriteCloser, body string) error {
+	b.body = body
+	return b.emailWriteCloser(w)
+}
+
+// partEncoding return Content-Transfer-Encoding of text part, 8bit only for part without writer function
+// and with CRLF lines up to 998 bytes
+func (b Builder) partEncoding(part []byte, f func(io.Writer) error) string {
+	switch {
+	case b.body == "":
+		return "quoted-printable"
+	case f == nil && is8bit(part):
+		return "8bit"
+	case b.body == BodyBinaryMIME:
+		return "binary"
+	}
+	return "quoted-printable"
+}
+
+// partWriter return writer for part encoding
+func partWriter(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == "quoted-printable" {
+		return quotedprintable.NewWriter(w)
+	}
+	return nopWriteCloser{w}
+}
+
+// is8bit check data is RFC 2045 8bit: CRLF lines up to 998 bytes without NUL
+func is8bit(data []byte) bool {
+	line := 0
+	for i, c := range data {
+		switch {
+		case c == 0:
+			return false
+		case c == '\r':
+			if i+1 == len(data) || data[i+1] != '\n' {
+				return false
+			}
+			continue
+		case c == '\n':
+			if i == 0 || data[i-1] != '\r' {
+				return false
+			}
+			line = 0
+			continue
+		}
+		if line++; line > 998 {
+			return false
+		}
+	}
+	return true
+}
+
 func (b Builder) emailWriteCloser(w io.WriteCloser) error {
 	var err error
 	defer w.Close()
@@ -263,6 +409,9 @@ func (b Builder) emailWriteCloser(w io.WriteCloser) error {
 		},
 		Signer: privateKey,
 	}
+	if len(b.cc) != 0 {
+		options.HeaderKeys = append(options.HeaderKeys, "Cc")
+	}
 
 	// dkimEmailDoubleWriteCloser
 	// BenchmarkBuilderDKIM-2             	    1000	   1689315 ns/op	   52760 B/op	    1130 allocs/op
@@ -488,12 +637,12 @@ func (b Builder) writeAlternativeHeader(w io.Writer) error {
 }
 
 func (b Builder) writeTextPartHeader(w io.Writer) error {
-	_, err := w.Write([]byte("Content-Type: text/plain; charset=\"utf-8\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n"))
+	_, err := w.Write([]byte("Content-Type: text/plain; charset=\"utf-8\"\r\nContent-Transfer-Encoding: " + b.partEncoding(b.textPart, b.textFunc) + "\r\n\r\n"))
 	return err
 }
 
 func (b Builder) writeAMPPartHeader(w io.Writer) error {
-	_, err := w.Write([]byte("Content-Type: text/x-amp-html; charset=\"utf-8\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n"))
+	_, err := w.Write([]byte("Content-Type: text/x-amp-html; charset=\"utf-8\"\r\nContent-Transfer-Encoding: " + b.partEncoding(b.ampPart, b.ampFunc) + "\r\n\r\n"))
 	return err
 }
 
@@ -506,7 +655,7 @@ func (b Builder) writeHTMLPartHeader(w io.Writer) error {
 			return err
 		}
 	}
-	_, err := w.Write([]byte("Content-Type: text/html; charset=\"utf-8\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n"))
+	_, err := w.Write([]byte("Content-Type: text/html; charset=\"utf-8\"\r\nContent-Transfer-Encoding: " + b.partEncoding(b.htmlPart, b.htmlFunc) + "\r\n\r\n"))
 	return err
 }
 
@@ -517,6 +666,11 @@ func (b Builder) writeHeaders(w io.Writer) error {
 	if _, err := w.Write([]byte("To: " + b.To + "\r\n")); err != nil {
 		return err
 	}
+	if len(b.cc) != 0 {
+		if _, err := w.Write([]byte("Cc: " + strings.Join(b.cc, ", ") + "\r\n")); err != nil {
+			return err
+		}
+	}
 	if b.replyTo != "" {
 		if _, err := w.Write([]byte("Reply-To: <" + b.replyTo + ">\r\n")); err != nil {
 			return err
@@ -582,7 +736,7 @@ func (b Builder) makeSubject() ([]byte, error) {
 
 // Text part
 func (b Builder) writeTextPart(w io.Writer) error {
-	q := quotedprintable.NewWriter(w)
+	q := partWriter(w, b.partEncoding(b.textPart, b.textFunc))
 
 	if _, err := q.Write(b.textPart); err != nil {
 		return err
@@ -609,7 +763,7 @@ func (b Builder) writeTextPart(w io.Writer) error {
 
 // AMP part
 func (b Builder) writeAMPPart(w io.Writer) error {
-	q := quotedprintable.NewWriter(w)
+	q := partWriter(w, b.partEncoding(b.ampPart, b.ampFunc))
 	if _, err := q.Write(b.ampPart); err != nil {
 		return err
 	}
@@ -635,7 +789,7 @@ func (b Builder) writeAMPPart(w io.Writer) error {
 
 // HTML part
 func (b Builder) writeHTMLPart(w io.Writer) error {
-	q := quotedprintable.NewWriter(w)
+	q := partWriter(w, b.partEncoding(b.htmlPart, b.htmlFunc))
 	if _, err := q.Write(b.htmlPart); err != nil {
 		return err
 	}
@@ -665,7 +819,7 @@ func (b Builder) writeHTMLPart(w io.Writer) error {
 			return err
 		}
 
-		if err := fileWriter(w, b.htmlRelatedFiles[i], "inline"); err != nil {
+		if err := fileWriter(w, b.htmlRelatedFiles[i], "inline", b.body == BodyBinaryMIME); err != nil {
 			return err
 		}
 		if _, err := w.Write([]byte("\r\n")); err != nil {
@@ -686,7 +840,7 @@ func (b Builder) writeAttachment(w io.Writer) error {
 		if _, err := w.Write([]byte(boundaryMixedBegin)); err != nil {
 			return err
 		}
-		if err := fileWriter(w, b.attachments[i], "attachment"); err != nil {
+		if err := fileWriter(w, b.attachments[i], "attachment", b.body == BodyBinaryMIME); err != nil {
 			return err
 		}
 		if _, err := w.Write([]byte("\r\n")); err != nil {
@@ -740,7 +894,8 @@ func (b Builder) isMultipart() bool {
 	return c > 1
 }
 
-func fileWriter(w io.Writer, f *os.File, disposition string) error {
+// fileWriter write file part base64 encoded or as is if binary
+func fileWriter(w io.Writer, f *os.File, disposition string, binary bool) error {
 	var err error
 	var info os.FileInfo
 	name := filepath.Base(f.Name())
@@ -763,10 +918,15 @@ func fileWriter(w io.Writer, f *os.File, disposition string) error {
 	if disposition == "inline" {
 		contentID = "Content-ID: <" + name + ">\r\n"
 	}
+	encoding := "base64"
+	if binary {
+		encoding = "binary"
+	}
 	_, err = w.Write([]byte(fmt.Sprintf(
-		"Content-Type: %s; name=\"%s\"\r\nContent-Transfer-Encoding: base64\r\n%sContent-Disposition: %s; filename=\"%s\"; size=%d;\r\n\r\n",
+		"Content-Type: %s; name=\"%s\"\r\nContent-Transfer-Encoding: %s\r\n%sContent-Disposition: %s; filename=\"%s\"; size=%d;\r\n\r\n",
 		content,
 		name,
+		encoding,
 		contentID,
 		disposition,
 		name,
@@ -775,6 +935,11 @@ func fileWriter(w io.Writer, f *os.File, disposition string) error {
 		return err
 	}
 
+	if binary {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
 	dwr := NewDelimitWriter(w, []byte{0x0d, 0x0a}, 76) // 76 from RFC
 	b64Enc := base64.NewEncoder(base64.StdEncoding, dwr)
 	_, err = io.Copy(b64Enc, f)
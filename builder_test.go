@@ -1,6 +1,7 @@
 package smtpSender_test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	tmplHTML "html/template"
@@ -111,6 +112,74 @@ func TestBuilderTemplate(t *testing.T) {
 	}
 }
 
+func TestBuilderSize(t *testing.T) {
+	bldr := smtpSender.NewBuilder().
+		SetFrom("Вася", "vasya@mail.tld").
+		SetTo("Петя", "petya@mail.tld").
+		SetSubject("Test subject").
+		AddTextPart(textPart)
+	if err := bldr.AddHTMLPart(htmlPart, "./testdata/prwoman.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bldr.AddAttachment("./testdata/knwoman.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	email := bldr.Email("Id-123", func(smtpSender.Result) {})
+	var buf bytes.Buffer
+	if err := email.WriteCloser(nopCloser{&buf}); err != nil {
+		t.Fatal(err)
+	}
+	// files are base64 encoded, headers are not estimated
+	if email.Size < (136561+312572)*4/3 || email.Size > buf.Len() {
+		t.Errorf("estimated size %d, rendered %d", email.Size, buf.Len())
+	}
+}
+
+func TestBuilderCcBcc(t *testing.T) {
+	bldr := smtpSender.NewBuilder().
+		SetFrom("Вася", "vasya@mail.tld").
+		SetTo("Петя", "petya@mail.tld").
+		AddCc("Маша", "masha@mail.tld").
+		AddCc("", "dasha@mail.tld").
+		AddBcc("Коля", "kolya@mail.tld").
+		SetSubject("Test subject")
+	bldr.AddTextPart(textPart)
+
+	email := bldr.Email("Id-123", func(smtpSender.Result) {})
+	want := []string{"=?utf-8?q?=D0=9C=D0=B0=D1=88=D0=B0?= <masha@mail.tld>", "<dasha@mail.tld>", "=?utf-8?q?=D0=9A=D0=BE=D0=BB=D1=8F?= <kolya@mail.tld>"}
+	if len(email.Recipients) != len(want) {
+		t.Fatalf("email has %d recipients, want %d", len(email.Recipients), len(want))
+	}
+	for i := range want {
+		if email.Recipients[i] != want[i] {
+			t.Errorf("recipient %d is '%s', want '%s'", i, email.Recipients[i], want[i])
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err := email.WriteCloser(nopCloser{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := textproto.NewReader(bufio.NewReader(buf)).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc := header.Get("Cc"); cc != want[0]+", "+want[1] {
+		t.Errorf("Cc header is '%s'", cc)
+	}
+	if _, ok := header["Bcc"]; ok {
+		t.Error("Bcc header written to message")
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
 func BenchmarkBuilder(b *testing.B) {
 	bldr := new(smtpSender.Builder)
 	bldr.SetSubject("Test subject")
@@ -0,0 +1,410 @@
+package smtpSender
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// smtpClient SMTP client like net/smtp Client with transcript of commands and replies
+type smtpClient struct {
+	Text       *textproto.Conn
+	conn       net.Conn
+	tls        bool
+	serverName string
+	localName  string
+	ext        map[string]string
+	auth       []string
+	mech       string
+	tr         *transcript
+}
+
+// newSMTPClient return client for connection after server greeting
+func newSMTPClient(conn net.Conn, host string, tr *transcript) (*smtpClient, error) {
+	c := &smtpClient{Text: textproto.NewConn(conn), conn: conn, serverName: host, tr: tr}
+	_, c.tls = conn.(*tls.Conn)
+	if _, _, err := c.reply(220); err != nil {
+		_ = c.Text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd send command and read reply with expectCode
+func (c *smtpClient) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	return c.send(expectCode, line, line)
+}
+
+// send line to server and record text in transcript instead of line, read reply with expectCode
+func (c *smtpClient) send(expectCode int, text, line string) (int, string, error) {
+	c.tr.add(c.serverName, true, text)
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.reply(expectCode)
+}
+
+// reply read server reply and record it in transcript
+func (c *smtpClient) reply(expectCode int) (int, string, error) {
+	code, msg, err := c.Text.ReadResponse(expectCode)
+	if code != 0 {
+		lines := strings.Split(msg, "\n")
+		for i := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			c.tr.add(c.serverName, false, fmt.Sprintf("%d%s%s", code, sep, lines[i]))
+		}
+	}
+	return code, msg, err
+}
+
+// Hello send EHLO or HELO if server does not support EHLO
+func (c *smtpClient) Hello(localName string) error {
+	if err := validateLine(localName); err != nil {
+		return err
+	}
+	c.localName = localName
+	err := c.ehlo()
+	if err != nil {
+		if _, _, err = c.cmd(250, "HELO %s", localName); err == nil {
+			c.ext = nil
+		}
+	}
+	return err
+}
+
+func (c *smtpClient) ehlo() error {
+	_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+	if err != nil {
+		return err
+	}
+	ext := map[string]string{}
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			ext[strings.ToUpper(args[0])] = args[1]
+		} else {
+			ext[strings.ToUpper(args[0])] = ""
+		}
+	}
+	if mechs, ok := ext["AUTH"]; ok {
+		c.auth = strings.Split(mechs, " ")
+	}
+	c.ext = ext
+	return nil
+}
+
+// Extension return true and parameters if server support extension
+func (c *smtpClient) Extension(ext string) (bool, string) {
+	if c.ext == nil {
+		return false, ""
+	}
+	param, ok := c.ext[strings.ToUpper(ext)]
+	return ok, param
+}
+
+// StartTLS send STARTTLS, make TLS handshake and repeat EHLO
+func (c *smtpClient) StartTLS(config *tls.Config) error {
+	if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.Text = textproto.NewConn(tlsConn)
+	c.tls = true
+	return c.ehlo()
+}
+
+// TLSConnectionState return TLS state if connection is encrypted
+func (c *smtpClient) TLSConnectionState() (tls.ConnectionState, bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// Auth authenticate by a, credentials are not recorded in transcript
+func (c *smtpClient) Auth(a smtp.Auth) error {
+	encoding := base64.StdEncoding
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.auth})
+	if err != nil {
+		return err
+	}
+	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+	encoding.Encode(resp64, resp)
+	text := "AUTH " + mech
+	if len(resp) != 0 {
+		text += " " + redacted
+	}
+	code, msg64, err := c.send(0, text, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// cancel authentication
+			_, _, _ = c.send(501, "*", "*")
+			break
+		}
+		if resp == nil {
+			break
+		}
+		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+		code, msg64, err = c.send(0, redacted, string(resp64))
+	}
+	if err == nil {
+		c.mech = mech
+	}
+	return err
+}
+
+// Mail send MAIL FROM with parameters
+func (c *smtpClient) Mail(from string, params ...string) error {
+	line, err := mailLine(from, params)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(250, "%s", line)
+	return err
+}
+
+// Rcpt send RCPT TO with parameters
+func (c *smtpClient) Rcpt(to string, params ...string) error {
+	line, err := rcptLine(to, params)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(25, "%s", line)
+	return err
+}
+
+// mailLine return MAIL FROM command
+func mailLine(from string, params []string) (string, error) {
+	line := "MAIL FROM:<" + from + ">" + joinParams(params)
+	return line, validateLine(line)
+}
+
+// rcptLine return RCPT TO command
+func rcptLine(to string, params []string) (string, error) {
+	line := "RCPT TO:<" + to + ">" + joinParams(params)
+	return line, validateLine(line)
+}
+
+// joinParams return command parameters with leading space
+func joinParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// Pipeline send commands in one write (RFC 2920), their replies must be read by reply in the same order
+func (c *smtpClient) Pipeline(lines []string) error {
+	for _, line := range lines {
+		c.tr.add(c.serverName, true, line)
+		if _, err := c.Text.W.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return c.Text.W.Flush()
+}
+
+// PipelineData read reply to pipelined DATA and return writer for message body.
+// If there are not accepted recipients, but server replied 354, then empty message is sent
+// to end transaction as RFC 2920 requires and nil writer returned.
+func (c *smtpClient) PipelineData(accepted bool) (*dataCloser, error) {
+	code, _, err := c.reply(354)
+	if code == 354 && !accepted {
+		if _, _, err = c.send(0, ".", "."); err != nil && !isReply(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dataCloser{c: c, w: c.Text.DotWriter()}, nil
+}
+
+// discardReplies read replies to n pipelined commands and DATA if data after failed MAIL FROM,
+// return false if connection is broken
+func (c *smtpClient) discardReplies(n int, data bool) bool {
+	for i := 0; i < n; i++ {
+		if _, _, err := c.reply(0); err != nil && !isReply(err) {
+			return false
+		}
+	}
+	if data {
+		if _, err := c.PipelineData(false); err != nil && !isReply(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// bdatChunkSize BDAT chunk size
+const bdatChunkSize = 1 << 20
+
+// dataCloser write message body after DATA or in BDAT chunks and read final reply on Close,
+// Close can be called many times and return the same error
+type dataCloser struct {
+	c *smtpClient
+	// w DATA dot writer, nil for BDAT
+	w io.WriteCloser
+	// chunk BDAT chunk buffer
+	chunk []byte
+	// crlf convert bare LF to CRLF in BDAT chunks
+	crlf   bool
+	cr     bool
+	size   int
+	reply  string
+	closed bool
+	err    error
+}
+
+func (d *dataCloser) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.w != nil {
+		n, err := d.w.Write(p)
+		d.size += n
+		return n, err
+	}
+	if d.crlf {
+		for _, c := range p {
+			if c == '\n' && !d.cr {
+				d.chunk = append(d.chunk, '\r')
+			}
+			d.cr = c == '\r'
+			d.chunk = append(d.chunk, c)
+		}
+	} else {
+		d.chunk = append(d.chunk, p...)
+	}
+	d.size += len(p)
+	if len(d.chunk) >= bdatChunkSize {
+		if d.err = d.bdat(false); d.err != nil {
+			return 0, d.err
+		}
+	}
+	return len(p), nil
+}
+
+// bdat send chunk with BDAT command and read reply, failed transaction is reset
+func (d *dataCloser) bdat(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(d.chunk))
+	if last {
+		cmd += " LAST"
+	}
+	d.c.tr.add(d.c.serverName, true, cmd)
+	if err := d.c.Text.PrintfLine("%s", cmd); err != nil {
+		return err
+	}
+	if _, err := d.c.Text.W.Write(d.chunk); err != nil {
+		return err
+	}
+	if err := d.c.Text.W.Flush(); err != nil {
+		return err
+	}
+	d.chunk = d.chunk[:0]
+	_, msg, err := d.c.reply(250)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); ok && !last {
+			_ = d.c.Reset()
+		}
+		return err
+	}
+	if last {
+		d.reply = msg
+	}
+	return nil
+}
+
+func (d *dataCloser) Close() error {
+	if d.closed {
+		return d.err
+	}
+	d.closed = true
+	if d.err != nil {
+		return d.err
+	}
+	if d.w == nil {
+		d.err = d.bdat(true)
+		return d.err
+	}
+	if d.err = d.w.Close(); d.err != nil {
+		return d.err
+	}
+	d.c.tr.add(d.c.serverName, true, fmt.Sprintf("<message body %d bytes>", d.size))
+	_, d.reply, d.err = d.c.reply(250)
+	return d.err
+}
+
+// Data send DATA and return writer for message body, server reply is read on writer Close
+func (c *smtpClient) Data() (*dataCloser, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &dataCloser{c: c, w: c.Text.DotWriter()}, nil
+}
+
+// Bdat return writer for message body sent in BDAT chunks (RFC 3030), last chunk is sent on writer Close.
+// If crlf bare LF is converted to CRLF, it must be false for BINARYMIME body.
+func (c *smtpClient) Bdat(crlf bool) *dataCloser {
+	return &dataCloser{c: c, crlf: crlf}
+}
+
+// Reset send RSET
+func (c *smtpClient) Reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+// Quit send QUIT and close connection
+func (c *smtpClient) Quit() error {
+	if _, _, err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return c.Text.Close()
+}
+
+// Close connection
+func (c *smtpClient) Close() error {
+	return c.Text.Close()
+}
+
+// validateLine check line has not CR or LF
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\n\r") {
+		return errors.New("smtp: a line must not contain CR or LF")
+	}
+	return nil
+}
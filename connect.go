@@ -1,6 +1,9 @@
 package smtpSender
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"golang.org/x/net/proxy"
 	"net"
@@ -13,19 +16,22 @@ import (
 	"time"
 )
 
-const (
-	dialTimeout = 60 * time.Second
-	dialTries   = 3
-	connTimeout = 5 * time.Minute // SMTP RFC 5 min
-	connTries   = 5
-)
-
 // Connect to smtp server from configured interface
 type Connect struct {
-	iface    string
-	hostname string
-	portSMTP int
-	mapIP    map[string]string
+	iface       string
+	hostname    string
+	portSMTP    int
+	mapIP       map[string]string
+	pool        *sessionPool
+	limiter     *rateLimiter
+	resolver    Resolver
+	tls         TLSOptions
+	sts         *MTASTS
+	dane        TLSAResolver
+	timeouts    Timeouts
+	lookupTries int
+	dialTries   int
+	logger      TranscriptLogger
 }
 
 // SetMapIP if use NAT set global IP address
@@ -56,80 +62,198 @@ func (c *Connect) SetHostName(name string) {
 	c.hostname = name
 }
 
-func (c *Connect) newClient(domain string, lookupMX bool) (client *smtp.Client, err error) {
+// SetTimeouts set dial and SMTP commands timeouts, zero fields use defaults
+func (c *Connect) SetTimeouts(timeouts Timeouts) {
+	c.timeouts = timeouts
+}
+
+// SetLookupTries set MX lookup tries. Default 3
+func (c *Connect) SetLookupTries(tries int) {
+	c.lookupTries = tries
+}
+
+// SetDialTries set connect to server tries. Default 5
+func (c *Connect) SetDialTries(tries int) {
+	c.dialTries = tries
+}
+
+// SetTLS set TLS policy and options for connect to servers. Default opportunistic STARTTLS
+func (c *Connect) SetTLS(options TLSOptions) {
+	c.tls = options
+}
+
+// SetMTASTS enforce recipient domains MTA-STS policies for direct delivery to MX
+func (c *Connect) SetMTASTS(sts *MTASTS) {
+	c.sts = sts
+}
+
+// SetDANE verify MX certificates by DNSSEC validated TLSA records (RFC 7672) for direct delivery,
+// DANE has priority over MTA-STS. MX host with validated but not usable records requires TLS without verification
+func (c *Connect) SetDANE(resolver TLSAResolver) {
+	c.dane = resolver
+}
+
+// SetResolver set DNS resolver for MX, A/AAAA and PTR lookups. Default net.DefaultResolver
+func (c *Connect) SetResolver(resolver Resolver) {
+	c.resolver = resolver
+}
+
+// SetTranscriptLogger stream SMTP conversation of every email to logger, AUTH credentials are redacted
+func (c *Connect) SetTranscriptLogger(logger TranscriptLogger) {
+	c.logger = logger
+}
+
+// newClient return SMTP session after EHLO, STARTTLS by tlsOpts policy and AUTH if auth not nil.
+// SMTP conversation is recorded to tr if it is not nil.
+// If Connect has session pool, then opened session for the same server reused.
+// Rate limits are matched by MX host and recipient domains of limits.
+func (c *Connect) newClient(ctx context.Context, domain string, lookupMX bool, auth authFunc, tlsOpts TLSOptions, tr *transcript, limits *deliveryLimits) (*session, error) {
 	var (
-		dialer func(network, address string) (net.Conn, error)
+		dialer dialFunc
 		mxs    []*net.MX
+		client *smtpClient
+		conn   *timeoutConn
+		server string
+		key    string
+		tlsa   []TLSA
+		err    error
+
+		remoteIP, localIP, proxy string
 	)
 
-	if c.portSMTP == 0 {
-		c.portSMTP = 25
+	port := c.portSMTP
+	if port == 0 {
+		port = 25
+		if tlsOpts.Implicit {
+			port = 465
+		}
+	}
+	timeouts := c.timeouts.withDefaults()
+	lookupTries := c.lookupTries
+	if lookupTries <= 0 {
+		lookupTries = defaultLookupTries
+	}
+	dialTries := c.dialTries
+	if dialTries <= 0 {
+		dialTries = defaultDialTries
+	}
+	resolver := c.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
 	}
 
-	if dialer, err = dialFunction(c.iface); err != nil {
-		return nil, err
+	if dialer, err = dialFunction(c.iface, timeouts.Dial); err != nil {
+		return nil, newSMTPError(StageDial, "", err)
 	}
 
+	var policy *mtaSTSPolicy
 	if lookupMX {
-		for tries := 0; tries < dialTries; tries++ {
-			mxs, err = net.LookupMX(domain)
-			if err == nil {
-				break
+		if mxs, err = resolveMX(ctx, resolver, domain, lookupTries); err != nil {
+			return nil, err
+		}
+		if c.sts != nil {
+			if policy = c.sts.policy(ctx, resolver, domain); policy.enforce() {
+				tlsOpts.Policy = TLSRequireVerify
 			}
-			time.Sleep(time.Second)
 		}
 	} else {
 		mxs = append(mxs, &net.MX{Host: domain, Pref: 10})
 	}
 
-	if len(mxs) == 0 {
-		return nil, fmt.Errorf("max MX lookup tries reached")
-	}
-
 	for i := range mxs {
-		var conn net.Conn
-		server := strings.TrimSpace(mxs[i].Host)
-		for tries := 1; tries <= connTries; tries++ {
-			conn, err = dialer("tcp", net.JoinHostPort(server, strconv.Itoa(c.portSMTP)))
-			if err == nil {
-				e := conn.SetDeadline(time.Now().Add(connTimeout))
-				if e != nil {
-					return nil, e
-				}
-				e = conn.SetReadDeadline(time.Now().Add(connTimeout))
-				if e != nil {
-					return nil, e
-				}
-				e = conn.SetWriteDeadline(time.Now().Add(connTimeout))
-				if e != nil {
-					return nil, e
+		server = strings.TrimSpace(mxs[i].Host)
+		tlsa = nil
+		if lookupMX && c.dane != nil {
+			if tlsa, err = daneRecords(ctx, c.dane, server, port); err != nil {
+				continue
+			}
+		}
+		if len(tlsa) == 0 && policy.enforce() && !policy.match(server) {
+			err = policy.error(server, nil)
+			continue
+		}
+		address := net.JoinHostPort(server, strconv.Itoa(port))
+		key = address + "/" + tlsOpts.Policy.String()
+		if tlsOpts.Implicit {
+			key += "/implicit"
+		}
+		if tlsa != nil {
+			key += "/dane"
+		}
+		lim := c.limiter.match(server, limits.domains...)
+		if err = limits.wait(ctx, lim); err != nil {
+			return nil, newSMTPError(StageDial, server, err)
+		}
+		if c.pool != nil {
+			if s := c.pool.get(key); s != nil {
+				s.tr = tr
+				return s, nil
+			}
+		}
+		var ips []string
+		if ips, err = resolveHost(ctx, resolver, server, lookupTries); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err = lim.acquire(ctx, c.pool.closeLimit); err != nil {
+			return nil, newSMTPError(StageDial, server, err)
+		}
+		var netConn net.Conn
+		for tries := 1; tries <= dialTries; tries++ {
+			for _, ip := range ips {
+				dialCtx, cancel := context.WithTimeout(ctx, timeouts.Dial)
+				netConn, err = dialer(dialCtx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+				cancel()
+				remoteIP = ip
+				if err == nil || ctx.Err() != nil {
+					break
 				}
+			}
+			if err == nil {
 				break
 			}
-			if tries != connTries {
-				time.Sleep(5 * time.Second)
+			if tries != dialTries && sleepContext(ctx, timeouts.DialRetry) != nil {
+				break
 			}
 		}
 		if err != nil {
-			return
+			lim.release()
+			err = newSMTPError(StageDial, server, ctxErr(ctx, err))
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		conn = &timeoutConn{Conn: netConn, limit: lim}
+		localIP, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		proxy = ""
+		if err = conn.timeout(timeouts.Greeting); err != nil {
+			_ = conn.Close()
+			return nil, newSMTPError(StageDial, server, err)
 		}
 
 		var ip string
 		if c.iface == "" {
 			ip, _, err = net.SplitHostPort(conn.LocalAddr().String())
 			if err != nil {
-				return nil, err
+				_ = conn.Close()
+				return nil, newSMTPError(StageDial, server, err)
 			}
 		} else {
 			var u *url.URL
 			u, err = url.Parse(c.iface)
 			if err != nil {
-				return nil, err
+				_ = conn.Close()
+				return nil, newSMTPError(StageDial, server, err)
 			}
 			if strings.ToLower(u.Scheme) == "socks" || strings.ToLower(u.Scheme) == "socks5" {
+				proxy = u.Host
 				ip, _, err = net.SplitHostPort(u.Host)
 				if err != nil {
-					return nil, err
+					_ = conn.Close()
+					return nil, newSMTPError(StageDial, server, err)
 				}
 			}
 		}
@@ -137,28 +261,190 @@ func (c *Connect) newClient(domain string, lookupMX bool) (client *smtp.Client,
 			ip = myGlobalIP
 		}
 		if c.hostname == "" {
-			name, err := lookup(ip)
+			name, err := lookup(ctx, resolver, ip)
 			if err != nil {
-				return nil, err
+				_ = conn.Close()
+				return nil, newSMTPError(StageEHLO, server, ctxErr(ctx, err))
 			}
 			c.hostname = name
 		}
 
-		client, err = smtp.NewClient(conn, server)
+		stop := watchContext(ctx, conn)
+		var smtpConn net.Conn = conn
+		if tlsOpts.Implicit {
+			tlsConn := tls.Client(conn, tlsOpts.config(server))
+			if err = tlsConn.Handshake(); err != nil {
+				stop()
+				_ = conn.Close()
+				return nil, newSMTPError(StageStartTLS, server, ctxErr(ctx, err))
+			}
+			smtpConn = tlsConn
+		}
+		client, err = newSMTPClient(smtpConn, server, tr)
+		if err == nil {
+			err = conn.timeout(timeouts.Command)
+		}
 		if err != nil {
+			stop()
+			_ = conn.Close()
+			err = newSMTPError(StageGreeting, server, ctxErr(ctx, err))
+			if ctx.Err() != nil {
+				return nil, err
+			}
 			continue
 		}
 		err = client.Hello(strings.TrimRight(c.hostname, "."))
+		if stop() {
+			_ = client.Close()
+			return nil, newSMTPError(StageEHLO, server, ctx.Err())
+		}
 		if err == nil {
 			break
 		}
+		_ = client.Close()
+		err = newSMTPError(StageEHLO, server, err)
 	}
 
 	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	starttls, _ := client.Extension("STARTTLS")
+	tlsConfig := tlsOpts.config(server)
+	// secure TLSA records without usable ones require TLS without DANE authentication
+	if len(tlsa) != 0 {
+		tlsConfig = daneConfig(tlsConfig, tlsa, server)
+	}
+	switch {
+	case tlsa == nil && (tlsOpts.Implicit || tlsOpts.Policy == TLSNone):
+	case starttls:
+		if err = client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			if tlsa != nil && ctx.Err() == nil {
+				return nil, daneError(server, err)
+			}
+			if tlsOpts.Policy == TLSOpportunistic && auth == nil && ctx.Err() == nil {
+				stop()
+				return c.newClient(ctx, domain, lookupMX, auth, TLSOptions{Policy: TLSNone}, tr, limits)
+			}
+			if policy.enforce() && ctx.Err() == nil {
+				return nil, policy.error(server, err)
+			}
+			return nil, newSMTPError(StageStartTLS, server, ctxErr(ctx, err))
+		}
+	case tlsa != nil:
+		_ = client.Quit()
+		_ = client.Close()
+		return nil, daneError(server, errors.New("STARTTLS is not offered"))
+	case tlsOpts.Policy == TLSRequire || tlsOpts.Policy == TLSRequireVerify:
+		_ = client.Quit()
+		_ = client.Close()
+		if policy.enforce() {
+			return nil, policy.error(server, errors.New("STARTTLS is not offered"))
+		}
+		return nil, &SMTPError{Code: 421, EnhancedCode: "4.7.4", Message: "TLS is required, but was not offered by host", Stage: StageStartTLS, Host: server}
+	}
+
+	if auth != nil {
+		_, mechanisms := client.Extension("AUTH")
+		var a smtp.Auth
+		if a, err = auth(ctx, strings.Fields(mechanisms)); err == nil && a != nil {
+			err = client.Auth(a)
+		}
+		if err != nil {
+			_ = client.Quit()
+			_ = client.Close()
+			return nil, newSMTPError(StageAuth, server, ctxErr(ctx, err))
+		}
+	}
+
+	if stop() {
+		_ = client.Close()
+		return nil, newSMTPError(StageAuth, server, ctx.Err())
+	}
+
+	return &session{
+		smtpClient: client,
+		conn:       conn,
+		timeouts:   timeouts,
+		key:        key,
+		host:       server,
+		remoteIP:   remoteIP,
+		localIP:    localIP,
+		proxy:      proxy,
+	}, nil
+}
+
+// closeSession return session to pool or quit it if reuse, else close failed session without QUIT
+func (c *Connect) closeSession(s *session, reuse bool) {
+	if !reuse {
+		// session stalled or broken, QUIT would wait for timeout again
+		_ = s.Close()
 		return
 	}
+	if c.pool != nil {
+		tr := s.tr
+		// idle session must not write to transcript of sent email
+		s.tr = nil
+		if c.pool.put(s) {
+			return
+		}
+		s.tr = tr
+	}
+	s.quit()
+}
 
-	return
+// ctxErr return context error instead of not reply err if context is done
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil && !isReply(err) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sleepContext sleep for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// watchContext interrupt I/O of conn when ctx is done.
+// Returned stop function must be called after I/O, it returns true if I/O was interrupted.
+func watchContext(ctx context.Context, conn *timeoutConn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.interrupt()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	var (
+		once   sync.Once
+		result bool
+	)
+	return func() bool {
+		once.Do(func() {
+			close(done)
+			result = <-interrupted
+		})
+		return result
+	}
 }
 
 var resolvedHosts struct {
@@ -166,7 +452,7 @@ var resolvedHosts struct {
 	sync.Mutex
 }
 
-func lookup(ip string) (string, error) {
+func lookup(ctx context.Context, r Resolver, ip string) (string, error) {
 	resolvedHosts.Lock()
 	defer resolvedHosts.Unlock()
 	if resolvedHosts.host == nil {
@@ -175,7 +461,7 @@ func lookup(ip string) (string, error) {
 	if name, ok := resolvedHosts.host[ip]; ok {
 		return name, nil
 	}
-	names, err := net.LookupAddr(ip)
+	names, err := r.LookupAddr(ctx, ip)
 	if err != nil {
 		return "", err
 	}
@@ -190,12 +476,14 @@ func lookup(ip string) (string, error) {
 	return resolvedHosts.host[ip], nil
 }
 
-func dialFunction(iface string) (dialFunc func(network, address string) (net.Conn, error), err error) {
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func dialFunction(iface string, timeout time.Duration) (dialer dialFunc, err error) {
 	if iface == "" {
 		iface := net.Dialer{
-			Timeout: dialTimeout,
+			Timeout: timeout,
 		}
-		dialFunc = iface.Dial
+		dialer = iface.DialContext
 	} else {
 		var u *url.URL
 		u, err = url.Parse(iface)
@@ -218,13 +506,19 @@ func dialFunction(iface string) (dialFunc func(network, address string) (net.Con
 					return
 				}
 			}
-			dialFunc = iface.Dial
+			if d, ok := iface.(proxy.ContextDialer); ok {
+				dialer = d.DialContext
+			} else {
+				dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+					return iface.Dial(network, address)
+				}
+			}
 		} else {
 			iface := net.Dialer{
 				LocalAddr: &net.TCPAddr{IP: net.ParseIP(iface)},
-				Timeout:   dialTimeout,
+				Timeout:   timeout,
 			}
-			dialFunc = iface.Dial
+			dialer = iface.DialContext
 		}
 	}
 	return
@@ -0,0 +1,312 @@
+package smtpSender
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTLSAServer  = "127.0.0.1:53"
+	defaultTLSATimeout = 5 * time.Second
+	typeTLSA           = dnsmessage.Type(52)
+	headerBitTC        = 1 << 9
+	headerBitAD        = 1 << 5
+)
+
+// TLSA DNS TLSA record
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSAResolver lookup TLSA records, secure is true only if answer is DNSSEC validated
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []TLSA, secure bool, err error)
+}
+
+// DNSTLSAResolver query TLSA records from DNS server and trust its DNSSEC validation (AD flag),
+// so server must be trusted validating resolver, for example local unbound
+type DNSTLSAResolver struct {
+	// Server address host:port. Default 127.0.0.1:53
+	Server string
+	// Timeout query timeout. Default 5 seconds
+	Timeout time.Duration
+}
+
+// LookupTLSA query TLSA records of name, not existing name return empty records without error
+func (r DNSTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	server := r.Server
+	if server == "" {
+		server = defaultTLSAServer
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultTLSATimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query, id, err := tlsaQuery(name)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := dnsRoundTrip(ctx, server, query)
+	if err != nil {
+		return nil, false, err
+	}
+	return parseTLSA(resp, id)
+}
+
+// tlsaQuery return TLSA query with DNSSEC OK and AD flags
+func tlsaQuery(name string) ([]byte, uint16, error) {
+	return dnsQuery(name, typeTLSA, true)
+}
+
+// dnsQuery return query of qtype records with EDNS0, with DNSSEC OK and AD flags if dnssec
+func dnsQuery(name string, qtype dnsmessage.Type, dnssec bool) ([]byte, uint16, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err = b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err = b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err = b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, dnssec); err != nil {
+		return nil, 0, err
+	}
+	if err = b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	if dnssec {
+		binary.BigEndian.PutUint16(msg[2:], binary.BigEndian.Uint16(msg[2:])|headerBitAD)
+	}
+	return msg, id, nil
+}
+
+// dnsRoundTrip send query to server over UDP and over TCP if response is truncated
+func dnsRoundTrip(ctx context.Context, server string, query []byte) ([]byte, error) {
+	resp, err := dnsExchange(ctx, "udp", server, query)
+	if err == nil && len(resp) > 2 && binary.BigEndian.Uint16(resp[2:])&headerBitTC != 0 {
+		resp, err = dnsExchange(ctx, "tcp", server, query)
+	}
+	return resp, err
+}
+
+// dnsExchange send query to server and return response
+func dnsExchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg[:2]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseTLSA return TLSA records from response and AD flag
+func parseTLSA(resp []byte, id uint16) ([]TLSA, bool, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, false, errors.New("wrong DNS response")
+	}
+	secure := binary.BigEndian.Uint16(resp[2:])&headerBitAD != 0
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, secure, nil
+	default:
+		return nil, false, fmt.Errorf("TLSA lookup: %s", h.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, false, err
+	}
+	var records []TLSA
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if rh.Type != typeTLSA {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(r.Data) < 4 {
+			continue
+		}
+		records = append(records, TLSA{Usage: r.Data[0], Selector: r.Data[1], MatchingType: r.Data[2], Data: r.Data[3:]})
+	}
+	return records, secure, nil
+}
+
+// daneRecords return usable (RFC 7672 DANE-TA and DANE-EE) DNSSEC validated TLSA records of MX host,
+// nil if host has not DANE. DNSSEC validated records without usable ones return empty not nil slice,
+// host still requires TLS without authentication (RFC 7672 2.2)
+func daneRecords(ctx context.Context, r TLSAResolver, host string, port int) ([]TLSA, error) {
+	name := "_" + strconv.Itoa(port) + "._tcp." + strings.TrimSuffix(host, ".")
+	records, secure, err := r.LookupTLSA(ctx, name)
+	if err != nil {
+		return nil, &SMTPError{Code: 421, EnhancedCode: "4.7.5", Message: "TLSA lookup failed: " + err.Error(), Stage: StageDANE, Host: host, Err: err}
+	}
+	if !secure {
+		return nil, nil
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	usable := []TLSA{}
+	for _, record := range records {
+		if (record.Usage == 2 || record.Usage == 3) && record.Selector <= 1 && record.MatchingType <= 2 {
+			usable = append(usable, record)
+		}
+	}
+	return usable, nil
+}
+
+// match true if certificate match record
+func (t TLSA) match(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if t.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch t.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, t.Data)
+}
+
+// daneConfig return config verified server certificate by TLSA records instead of roots
+func daneConfig(config *tls.Config, records []TLSA, host string) *tls.Config {
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return daneVerify(rawCerts, records, host)
+	}
+	return config
+}
+
+// daneVerify verify certificates chain by DANE-EE or DANE-TA records
+func daneVerify(rawCerts [][]byte, records []TLSA, host string) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("DANE: server has not certificate")
+	}
+	for _, record := range records {
+		switch record.Usage {
+		case 3:
+			if record.match(certs[0]) {
+				return nil
+			}
+		case 2:
+			for _, ta := range certs {
+				if record.match(ta) && verifyChain(certs, ta, host) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("DANE: certificate does not match TLSA records")
+}
+
+// verifyChain verify server certificate issued by trust anchor ta for host
+func verifyChain(certs []*x509.Certificate, ta *x509.Certificate, host string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ta)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       strings.TrimSuffix(host, "."),
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// daneError return DANE failure error for MX host
+func daneError(host string, err error) *SMTPError {
+	return &SMTPError{Code: 421, EnhancedCode: "4.7.5", Message: "DANE validation failed: " + err.Error(), Stage: StageDANE, Host: host, Err: err}
+}
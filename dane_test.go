@@ -0,0 +1,110 @@
+package smtpSender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testCertificate create certificate signed by parent or self-signed if parent is nil
+func testCertificate(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if !ca {
+		template.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestDANEVerify(t *testing.T) {
+	ca, caKey := testCertificate(t, "Test CA", true, nil, nil)
+	leaf, _ := testCertificate(t, "mx.domain.tld", false, ca, caKey)
+	chain := [][]byte{leaf.Raw, ca.Raw}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	caSum := sha256.Sum256(ca.Raw)
+
+	tests := []struct {
+		record TLSA
+		host   string
+		ok     bool
+	}{
+		{TLSA{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]}, "other.domain.tld", true},
+		{TLSA{Usage: 3, Selector: 0, MatchingType: 0, Data: leaf.Raw}, "mx.domain.tld", true},
+		{TLSA{Usage: 3, Selector: 0, MatchingType: 1, Data: caSum[:]}, "mx.domain.tld", false},
+		{TLSA{Usage: 2, Selector: 0, MatchingType: 1, Data: caSum[:]}, "mx.domain.tld.", true},
+		{TLSA{Usage: 2, Selector: 0, MatchingType: 1, Data: caSum[:]}, "other.domain.tld", false},
+	}
+	for i, test := range tests {
+		if err := daneVerify(chain, []TLSA{test.record}, test.host); (err == nil) != test.ok {
+			t.Errorf("test %d verify result '%v'", i, err)
+		}
+	}
+}
+
+func TestParseTLSA(t *testing.T) {
+	query, id, err := tlsaQuery("_25._tcp.mx.domain.tld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(query[2:])&headerBitAD == 0 {
+		t.Error("query has not AD flag")
+	}
+
+	name := dnsmessage.MustNewName("_25._tcp.mx.domain.tld.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RecursionAvailable: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET})
+	_ = b.StartAnswers()
+	_ = b.UnknownResource(
+		dnsmessage.ResourceHeader{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET, TTL: 300},
+		dnsmessage.UnknownResource{Type: typeTLSA, Data: []byte{3, 1, 1, 0xde, 0xad}},
+	)
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(resp[2:], binary.BigEndian.Uint16(resp[2:])|headerBitAD)
+
+	records, secure, err := parseTLSA(resp, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure || len(records) != 1 || records[0].Usage != 3 || records[0].Selector != 1 ||
+		records[0].MatchingType != 1 || string(records[0].Data) != "\xde\xad" {
+		t.Errorf("wrong parsed records %+v secure %t", records, secure)
+	}
+	if _, _, err = parseTLSA(resp, id+1); err == nil {
+		t.Error("response with wrong id parsed")
+	}
+}
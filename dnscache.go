@@ -0,0 +1,223 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSCacheMaxAge         = 5 * time.Minute
+	defaultDNSCacheNegativeMaxAge = time.Minute
+)
+
+// DNSCache caching Resolver for bulk sending, safe for concurrent use.
+// MX and host answers of TTLResolver are kept for records TTL, not found answers for SOA negative TTL,
+// but not longer than maxAge and negativeMaxAge. Other answers are kept for maxAge and negativeMaxAge,
+// temporary errors are not cached. Concurrent lookups of the same name wait for one query.
+type DNSCache struct {
+	resolver       Resolver
+	maxAge         time.Duration
+	negativeMaxAge time.Duration
+	mu             sync.Mutex
+	entries        map[string]*dnsEntry
+	stats          DNSCacheStats
+	purged         time.Time
+}
+
+// DNSCacheStats cache statistics
+type DNSCacheStats struct {
+	// Hits answers from cache including negative
+	Hits uint64
+	// NegativeHits not found answers from cache
+	NegativeHits uint64
+	// Misses queries to resolver
+	Misses uint64
+	// Entries cached names count
+	Entries int
+}
+
+type dnsEntry struct {
+	ready  chan struct{}
+	expire time.Time
+	value  interface{}
+	err    error
+}
+
+// NewDNSCache return cache for resolver, nil resolver use DNSResolver with system nameserver.
+// maxAge and negativeMaxAge limit cache time of found and not found answers.
+// Zero maxAge is 5 minutes, zero negativeMaxAge is 1 minute.
+func NewDNSCache(resolver Resolver, maxAge, negativeMaxAge time.Duration) *DNSCache {
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	if maxAge <= 0 {
+		maxAge = defaultDNSCacheMaxAge
+	}
+	if negativeMaxAge <= 0 {
+		negativeMaxAge = defaultDNSCacheNegativeMaxAge
+	}
+	return &DNSCache{
+		resolver:       resolver,
+		maxAge:         maxAge,
+		negativeMaxAge: negativeMaxAge,
+		entries:        map[string]*dnsEntry{},
+		purged:         time.Now(),
+	}
+}
+
+// LookupMX return cached MX records of name
+func (c *DNSCache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := c.lookup(ctx, "MX "+name, func() (interface{}, time.Duration, error) {
+		if r, ok := c.resolver.(TTLResolver); ok {
+			return r.LookupMXTTL(ctx, name)
+		}
+		mxs, err := c.resolver.LookupMX(ctx, name)
+		return mxs, c.maxAge, err
+	})
+	mxs, _ := v.([]*net.MX)
+	return append([]*net.MX(nil), mxs...), err
+}
+
+// LookupHost return cached addresses of host
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	v, err := c.lookup(ctx, "A "+host, func() (interface{}, time.Duration, error) {
+		if r, ok := c.resolver.(TTLResolver); ok {
+			return r.LookupHostTTL(ctx, host)
+		}
+		addrs, err := c.resolver.LookupHost(ctx, host)
+		return addrs, c.maxAge, err
+	})
+	addrs, _ := v.([]string)
+	return append([]string(nil), addrs...), err
+}
+
+// LookupAddr return cached names of addr
+func (c *DNSCache) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	v, err := c.lookup(ctx, "PTR "+addr, func() (interface{}, time.Duration, error) {
+		names, err := c.resolver.LookupAddr(ctx, addr)
+		return names, c.maxAge, err
+	})
+	names, _ := v.([]string)
+	return append([]string(nil), names...), err
+}
+
+// LookupTXT return cached TXT records of name
+func (c *DNSCache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := c.lookup(ctx, "TXT "+name, func() (interface{}, time.Duration, error) {
+		txts, err := c.resolver.LookupTXT(ctx, name)
+		return txts, c.maxAge, err
+	})
+	txts, _ := v.([]string)
+	return append([]string(nil), txts...), err
+}
+
+// Stats return cache statistics
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Flush remove all cached answers
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if isReady(e) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// lookup return cached answer for key or query it once for all concurrent callers
+func (c *DNSCache) lookup(ctx context.Context, key string, query func() (interface{}, time.Duration, error)) (interface{}, error) {
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if ok && isReady(e) && time.Now().After(e.expire) {
+			delete(c.entries, key)
+			ok = false
+		}
+		if !ok {
+			c.stats.Misses++
+			c.purge()
+			e = &dnsEntry{ready: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			return c.query(key, e, query)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// other caller query canceled with its context, query again
+		if errors.Is(e.err, context.Canceled) || errors.Is(e.err, context.DeadlineExceeded) {
+			continue
+		}
+		c.mu.Lock()
+		c.stats.Hits++
+		if e.err != nil {
+			c.stats.NegativeHits++
+		}
+		c.mu.Unlock()
+		return e.value, e.err
+	}
+}
+
+// query resolve entry, answer is kept for its TTL limited by max age if it is found or not found
+func (c *DNSCache) query(key string, e *dnsEntry, query func() (interface{}, time.Duration, error)) (interface{}, error) {
+	var ttl time.Duration
+	e.value, ttl, e.err = query()
+	c.mu.Lock()
+	switch {
+	case e.err == nil:
+		e.expire = time.Now().Add(minDuration(ttl, c.maxAge))
+	case isNotFound(e.err):
+		e.expire = time.Now().Add(minDuration(ttl, c.negativeMaxAge))
+	default:
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+	}
+	close(e.ready)
+	c.mu.Unlock()
+	return e.value, e.err
+}
+
+// purge remove expired entries not often than once per maxAge, must be called with lock
+func (c *DNSCache) purge() {
+	if time.Since(c.purged) < c.maxAge {
+		return
+	}
+	now := time.Now()
+	for key, e := range c.entries {
+		if isReady(e) && now.After(e.expire) {
+			delete(c.entries, key)
+		}
+	}
+	c.purged = now
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func isReady(e *dnsEntry) bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,133 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countResolver count MX queries, "notexist.tld" is not found, "fail.tld" has temporary error
+type countResolver struct {
+	queries int32
+}
+
+func (r *countResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	atomic.AddInt32(&r.queries, 1)
+	time.Sleep(10 * time.Millisecond)
+	switch name {
+	case "notexist.tld":
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	case "fail.tld":
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+}
+
+func (r *countResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *countResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *countResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestDNSCache(t *testing.T) {
+	r := &countResolver{}
+	cache := NewDNSCache(r, time.Minute, time.Minute)
+	ctx := context.Background()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mxs, err := cache.LookupMX(ctx, "domain.tld")
+			if err != nil || len(mxs) != 1 || mxs[0].Host != "mx.domain.tld" {
+				t.Errorf("lookup MX return %v, %v", mxs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if q := atomic.LoadInt32(&r.queries); q != 1 {
+		t.Errorf("resolver queried %d times, want 1", q)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.LookupMX(ctx, "notexist.tld"); !isNotFound(err) {
+			t.Errorf("lookup not existing domain return '%v'", err)
+		}
+		if _, err := cache.LookupMX(ctx, "fail.tld"); err == nil || isNotFound(err) {
+			t.Errorf("lookup failed domain return '%v'", err)
+		}
+	}
+	if q := atomic.LoadInt32(&r.queries); q != 4 {
+		t.Errorf("resolver queried %d times, want 4", q)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 10 || stats.NegativeHits != 1 || stats.Misses != 4 || stats.Entries != 2 {
+		t.Errorf("wrong stats %+v", stats)
+	}
+
+	cache.Flush()
+	if _, err := cache.LookupMX(ctx, "domain.tld"); err != nil {
+		t.Error(err)
+	}
+	if q := atomic.LoadInt32(&r.queries); q != 5 {
+		t.Errorf("resolver queried %d times after flush, want 5", q)
+	}
+}
+
+// ttlResolver return MX records with TTL 50ms, "notexist.tld" is not found with TTL 50ms
+type ttlResolver struct {
+	countResolver
+}
+
+func (r *ttlResolver) LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	mxs, err := r.LookupMX(ctx, name)
+	return mxs, 50 * time.Millisecond, err
+}
+
+func (r *ttlResolver) LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	return addrs, 50 * time.Millisecond, err
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	r := &ttlResolver{}
+	cache := NewDNSCache(r, time.Minute, time.Minute)
+	ctx := context.Background()
+
+	for _, name := range []string{"domain.tld", "notexist.tld", "domain.tld", "notexist.tld"} {
+		_, _ = cache.LookupMX(ctx, name)
+	}
+	if q := atomic.LoadInt32(&r.queries); q != 2 {
+		t.Errorf("resolver queried %d times, want 2", q)
+	}
+	// answers expire after records TTL
+	time.Sleep(60 * time.Millisecond)
+	for _, name := range []string{"domain.tld", "notexist.tld"} {
+		_, _ = cache.LookupMX(ctx, name)
+	}
+	if q := atomic.LoadInt32(&r.queries); q != 4 {
+		t.Errorf("resolver queried %d times after TTL, want 4", q)
+	}
+
+	// max age limit records TTL
+	r = &ttlResolver{}
+	cache = NewDNSCache(r, 10*time.Millisecond, 10*time.Millisecond)
+	_, _ = cache.LookupMX(ctx, "domain.tld")
+	time.Sleep(20 * time.Millisecond)
+	_, _ = cache.LookupMX(ctx, "domain.tld")
+	if q := atomic.LoadInt32(&r.queries); q != 2 {
+		t.Errorf("resolver queried %d times after max age, want 2", q)
+	}
+}
@@ -0,0 +1,205 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSServer  = "127.0.0.1:53"
+	defaultDNSTimeout = 5 * time.Second
+)
+
+// TTLResolver Resolver which also return TTL of MX and host answers, DNSCache keep them for this TTL.
+// Not found answers return negative caching TTL from SOA record (RFC 2308), zero if it is unknown.
+type TTLResolver interface {
+	Resolver
+	LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error)
+	LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error)
+}
+
+// DNSResolver TTLResolver query MX, A and AAAA records from DNS server.
+// PTR and TXT lookups use net.DefaultResolver.
+type DNSResolver struct {
+	// Server address host:port. Default the first nameserver of /etc/resolv.conf or 127.0.0.1:53
+	Server string
+	// Timeout query timeout. Default 5 seconds
+	Timeout time.Duration
+}
+
+// LookupMX return MX records of name
+func (r DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, _, err := r.LookupMXTTL(ctx, name)
+	return mxs, err
+}
+
+// LookupHost return IPv4 and IPv6 addresses of host
+func (r DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, _, err := r.LookupHostTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupAddr return names of addr from net.DefaultResolver
+func (r DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// LookupTXT return TXT records of name from net.DefaultResolver
+func (r DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+// LookupMXTTL return MX records of name and the least TTL of answer
+func (r DNSResolver) LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	answers, ttl, err := r.query(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, ttl, err
+	}
+	var mxs []*net.MX
+	for _, answer := range answers {
+		if mx, ok := answer.Body.(*dnsmessage.MXResource); ok {
+			mxs = append(mxs, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+		}
+	}
+	return mxs, ttl, nil
+}
+
+// LookupHostTTL return IPv4 and IPv6 addresses of host and the least TTL of both answers
+func (r DNSResolver) LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	var (
+		addrs    []string
+		ttl      time.Duration
+		notFound error
+	)
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, t, err := r.query(ctx, host, qtype)
+		if err != nil && !isNotFound(err) {
+			return nil, 0, err
+		}
+		if i == 0 || t < ttl {
+			ttl = t
+		}
+		notFound = err
+		for _, answer := range answers {
+			switch a := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(a.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(a.AAAA[:]).String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ttl, notFound
+	}
+	return addrs, ttl, nil
+}
+
+// query return qtype records of name with TTL
+func (r DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	server := r.Server
+	if server == "" {
+		server = systemDNSServer()
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query, id, err := dnsQuery(name, qtype, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := dnsRoundTrip(ctx, server, query)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTimeout: ctx.Err() != nil, IsTemporary: true}
+	}
+	return parseAnswer(resp, id, name, qtype)
+}
+
+// parseAnswer return qtype records from response and the least TTL of answer records.
+// Not existing name or records return not found error with negative caching TTL from SOA record.
+func parseAnswer(resp []byte, id uint16, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("wrong DNS response")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + h.RCode.String(), Name: name, IsTemporary: true}
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		records []dnsmessage.Resource
+		ttl     uint32
+	)
+	for i, answer := range answers {
+		// CNAME chain TTL counts too
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		if answer.Header.Type == qtype {
+			records = append(records, answer)
+		}
+	}
+	if h.RCode == dnsmessage.RCodeSuccess && len(records) != 0 {
+		return records, time.Duration(ttl) * time.Second, nil
+	}
+
+	authorities, err := p.AllAuthorities()
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl = 0
+	for _, authority := range authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl = authority.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+		}
+	}
+	return nil, time.Duration(ttl) * time.Second, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+var (
+	systemDNSOnce sync.Once
+	systemDNS     string
+)
+
+// systemDNSServer return the first nameserver of /etc/resolv.conf or 127.0.0.1:53
+func systemDNSServer() string {
+	systemDNSOnce.Do(func() {
+		systemDNS = defaultDNSServer
+		data, err := ioutil.ReadFile("/etc/resolv.conf")
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				systemDNS = net.JoinHostPort(fields[1], "53")
+				return
+			}
+		}
+	})
+	return systemDNS
+}
@@ -0,0 +1,71 @@
+package smtpSender
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseAnswer(t *testing.T) {
+	name := dnsmessage.MustNewName("domain.tld.")
+	header := func(rtype dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	_, id, err := dnsQuery("domain.tld", dnsmessage.TypeMX, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RecursionAvailable: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET})
+	_ = b.StartAnswers()
+	_ = b.MXResource(header(dnsmessage.TypeMX, 300), dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx1.domain.tld.")})
+	_ = b.MXResource(header(dnsmessage.TypeMX, 120), dnsmessage.MXResource{Pref: 20, MX: dnsmessage.MustNewName("mx2.domain.tld.")})
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, ttl, err := parseAnswer(resp, id, "domain.tld", dnsmessage.TypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || ttl != 120*time.Second {
+		t.Errorf("parsed %d records with TTL %s, want 2 with TTL 2m0s", len(records), ttl)
+	}
+	if mx, ok := records[0].Body.(*dnsmessage.MXResource); !ok || mx.MX.String() != "mx1.domain.tld." {
+		t.Errorf("wrong parsed record %+v", records[0])
+	}
+
+	// not existing name has SOA negative TTL
+	b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: dnsmessage.RCodeNameError})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET})
+	_ = b.StartAuthorities()
+	_ = b.SOAResource(header(dnsmessage.TypeSOA, 3600), dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns.tld."),
+		MBox:   dnsmessage.MustNewName("hostmaster.tld."),
+		MinTTL: 60,
+	})
+	resp, err = b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ttl, err = parseAnswer(resp, id, "domain.tld", dnsmessage.TypeMX)
+	if !isNotFound(err) || ttl != time.Minute {
+		t.Errorf("not existing name return '%v' with TTL %s, want not found with TTL 1m0s", err, ttl)
+	}
+
+	if _, _, err = parseAnswer(resp, id+1, "domain.tld", dnsmessage.TypeMX); err == nil {
+		t.Error("response with wrong id parsed")
+	}
+	var dnsErr *net.DNSError
+	b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: dnsmessage.RCodeServerFailure})
+	resp, _ = b.Finish()
+	if _, _, err = parseAnswer(resp, id, "domain.tld", dnsmessage.TypeMX); !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+		t.Errorf("server failure return '%v'", err)
+	}
+}
@@ -0,0 +1,83 @@
+package smtpSender
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DSN RET values
+const (
+	DSNReturnFull    = "FULL"
+	DSNReturnHeaders = "HDRS"
+)
+
+// DSN NOTIFY values, DSNNotifyNever can't be combined with others
+const (
+	DSNNotifyNever   = "NEVER"
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+// DSN RFC 3461 delivery status notification request, parameters are sent only if server support DSN
+type DSN struct {
+	// Return RET parameter DSNReturnFull or DSNReturnHeaders, empty use server default
+	Return string
+	// EnvelopeID ENVID parameter, returned in notification for reconciliation
+	EnvelopeID string
+	// Notify NOTIFY parameter for every recipient, empty use server default
+	Notify []string
+}
+
+// mailParams return MAIL FROM parameters
+func (d *DSN) mailParams() []string {
+	var params []string
+	if d.Return != "" {
+		params = append(params, "RET="+strings.ToUpper(d.Return))
+	}
+	if d.EnvelopeID != "" {
+		params = append(params, "ENVID="+xtext(d.EnvelopeID))
+	}
+	return params
+}
+
+// rcptParams return RCPT TO parameters with original recipient rcpt
+func (d *DSN) rcptParams(rcpt string) []string {
+	var params []string
+	if len(d.Notify) != 0 {
+		params = append(params, "NOTIFY="+strings.ToUpper(strings.Join(d.Notify, ",")))
+	}
+	if isASCII(rcpt) {
+		params = append(params, "ORCPT=rfc822;"+xtext(rcpt))
+	} else {
+		params = append(params, "ORCPT=utf-8;"+utf8AddrXtext(rcpt))
+	}
+	return params
+}
+
+// xtext encode s as RFC 3461 xtext
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// utf8AddrXtext encode s as RFC 6533 utf-8-addr-xtext, non-ASCII characters are sent as is with SMTPUTF8
+func utf8AddrXtext(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < '!' || r == '+' || r == '=' || r == '\\' || r == 0x7F {
+			fmt.Fprintf(&b, "\\x{%X}", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
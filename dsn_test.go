@@ -0,0 +1,37 @@
+package smtpSender
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestXtext(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"id-123", "id-123"},
+		{"a+b=c d", "a+2Bb+3Dc+20d"},
+		{"user@domain.tld", "user@domain.tld"},
+	}
+	for _, test := range tests {
+		if got := xtext(test.in); got != test.want {
+			t.Errorf("xtext '%s' = '%s', want '%s'", test.in, got, test.want)
+		}
+	}
+	if got, want := utf8AddrXtext("пользователь+1@пример.рф"), `пользователь\x{2B}1@пример.рф`; got != want {
+		t.Errorf("utf8AddrXtext = '%s', want '%s'", got, want)
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	dsn := &DSN{Return: "hdrs", EnvelopeID: "id 1", Notify: []string{DSNNotifyFailure, DSNNotifyDelay}}
+	if got, want := dsn.mailParams(), []string{"RET=HDRS", "ENVID=id+201"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mail params %q, want %q", got, want)
+	}
+	if got, want := dsn.rcptParams("user+tag@domain.tld"), []string{"NOTIFY=FAILURE,DELAY", "ORCPT=rfc822;user+2Btag@domain.tld"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rcpt params %q, want %q", got, want)
+	}
+	if got, want := (&DSN{}).mailParams(), []string(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("empty mail params %q, want %q", got, want)
+	}
+}
@@ -1,13 +1,17 @@
 package smtpSender
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
-	"net/smtp"
+	"net/textproto"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 // Email struct
@@ -24,19 +28,72 @@ type Email struct {
 	// To emailField has format as From
 	To                        string
 	toName, toEmail, toDomain string
+	// Recipients additional envelope recipients (Cc, Bcc), each has format as From
+	Recipients []string
+	recipients []string
 	// ResultFunc exec after send emil
 	ResultFunc func(Result)
 	// WriteCloser email body data writer function
 	WriteCloser func(io.WriteCloser) error
+	// bodyWriter render email with 8bit or binary parts allowed by body type
+	bodyWriter func(w io.WriteCloser, body string) error
+	body       string
 	// DontUseTLS STARTTLS off
 	DontUseTLS bool
+	// Transcript keep SMTP conversation in Result, AUTH credentials are redacted
+	Transcript bool
+	// DSN delivery status notification request, used if server support DSN
+	DSN *DSN
+	// Size message size in bytes or its estimate, zero if unknown. If server support SIZE extension,
+	// size is declared in MAIL FROM and email exceeded server limit is failed without transmitting
+	Size  int
+	retry *retryEmail
+	spool string
+	ctx   context.Context
+	// start and attempts of previous runs restored from spool
+	start    time.Time
+	attempts int
 }
 
 // Result struct for return send emailField result
 type Result struct {
 	ID       string
 	Duration time.Duration
-	Err      error
+	// Err is nil if email accepted at least for one recipient
+	Err error
+	// Rcpt results for each envelope recipient
+	Rcpt []RcptResult
+	// Transcript SMTP conversation if Email.Transcript is set
+	Transcript []TranscriptLine
+	// Host MX or relay host name. Delivery fields describe the last session accepted message,
+	// or the last opened session if message was not accepted
+	Host string
+	// RemoteIP server IP address
+	RemoteIP string
+	// LocalIP source IP address of connection to server or to proxy
+	LocalIP string
+	// Proxy SOCKS5 proxy address if used
+	Proxy string
+	// HeloName name sent in EHLO/HELO
+	HeloName string
+	// TLSVersion for example "TLS 1.3", empty if session is not encrypted
+	TLSVersion string
+	// TLSCipher cipher suite name
+	TLSCipher string
+	// Auth SMTP AUTH mechanism, empty if session is not authenticated
+	Auth string
+	// Reply server reply text to message data, usually has server queue ID
+	Reply string
+	// Size message size in bytes
+	Size int
+	// Attempts delivery attempts count, more than 1 if Pipe resent email by RetryPolicy
+	Attempts int
+}
+
+// RcptResult send result for one envelope recipient
+type RcptResult struct {
+	Email string
+	Err   error
 }
 
 // SMTPserver use for send email from server
@@ -45,84 +102,314 @@ type SMTPserver struct {
 	Port     int
 	Username string
 	Password string
+	// AuthMethod SMTP AUTH mechanism AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAUTH2 or AuthExternal.
+	// Default XOAUTH2 if TokenProvider set, EXTERNAL if TLS client certificate set and server support it,
+	// else PLAIN, LOGIN or CRAM-MD5 supported by server
+	AuthMethod string
+	// TokenProvider OAuth2 access token source for XOAUTH2
+	TokenProvider TokenProvider
+	// TLS options for this server instead of Connect TLS options
+	TLS *TLSOptions
 }
 
 // Send sending this email
 func (e *Email) Send(connect *Connect, server *SMTPserver) {
+	e.SendContext(context.Background(), connect, server)
+}
+
+// SendContext sending this email, if ctx is done DNS lookup, dial and SMTP conversation
+// are aborted and result has SMTPError with context error
+func (e *Email) SendContext(ctx context.Context, connect *Connect, server *SMTPserver) {
 	if connect == nil {
 		connect = &Connect{}
 	}
 
 	var (
-		client *smtp.Client
-		auth   smtp.Auth
-		err    error
+		s   *session
+		err error
 	)
 	start := time.Now()
 	err = e.parseEmail()
 	if err != nil {
 		if e.ResultFunc != nil {
-			e.ResultFunc(Result{ID: e.ID, Err: fmt.Errorf("513 %v", err), Duration: time.Since(start)})
+			e.ResultFunc(Result{ID: e.ID, Err: &SMTPError{Code: 513, Message: err.Error(), Stage: StageParse, Err: err}, Duration: time.Since(start)})
 		}
 		return
 	}
+
+	tr := newTranscript(e.ID, e.Transcript, connect.logger)
+	results := map[string]error{}
+	res := Result{ID: e.ID, Attempts: 1}
 	if server == nil {
-		client, err = connect.newClient(e.toDomain, true)
+		domains, rcpts := e.rcptByDomain()
+		for _, domain := range domains {
+			s, err = connect.newClient(ctx, domain, true, nil, e.tlsOptions(connect.tls), tr, newDeliveryLimits(domain))
+			if err != nil {
+				setRcptErr(results, rcpts[domain], err)
+				continue
+			}
+			connect.closeSession(s, e.send(ctx, s, rcpts[domain], results, &res))
+		}
 	} else {
-		auth = smtp.PlainAuth(
-			"",
-			server.Username,
-			server.Password,
-			server.Host,
-		)
+		tlsOpts := connect.tls
+		if server.TLS != nil {
+			tlsOpts = *server.TLS
+		}
 		connect.SetSMTPport(server.Port)
-		client, err = connect.newClient(server.Host, false)
-	}
-	if err != nil {
-		e.ResultFunc(Result{ID: e.ID, Err: fmt.Errorf("421 %v", err), Duration: time.Since(start)})
-		return
+		// relay rate limits are matched by recipient domains too
+		domains, _ := e.rcptByDomain()
+		s, err = connect.newClient(ctx, server.Host, false, server.authFunc(len(tlsOpts.Certificates) != 0), e.tlsOptions(tlsOpts), tr, newDeliveryLimits(domains...))
+		if err != nil {
+			setRcptErr(results, e.recipients, err)
+		} else {
+			connect.closeSession(s, e.send(ctx, s, e.recipients, results, &res))
+		}
 	}
 
-	err = e.send(auth, client)
-	e.ResultFunc(Result{ID: e.ID, Err: err, Duration: time.Since(start)})
+	if e.ResultFunc != nil {
+		e.result(&res, results, start)
+		res.Transcript = tr.result()
+		e.ResultFunc(res)
+	}
 }
 
-func (e *Email) send(auth smtp.Auth, client *smtp.Client) error {
-	var (
-		err error
-	)
-	if ok, _ := client.Extension("STARTTLS"); ok && !e.DontUseTLS {
-		config := &tls.Config{ServerName: e.toDomain, InsecureSkipVerify: true}
-		if err = client.StartTLS(config); err != nil {
-			return err
+// send email to rcpt over session, set result for each recipient and session delivery fields to res.
+// Return true if session can be used for next email.
+func (e *Email) send(ctx context.Context, s *session, rcpt []string, results map[string]error, res *Result) (reuse bool) {
+	if res.Reply == "" {
+		s.describe(res)
+	}
+	if err := s.conn.timeout(s.timeouts.Mail); err != nil {
+		setRcptErr(results, rcpt, newSMTPError(StageMail, s.host, err))
+		return false
+	}
+	stop := watchContext(ctx, s.conn)
+	defer func() {
+		if stop() {
+			reuse = false
 		}
+	}()
+
+	smtputf8 := !isASCII(e.from())
+	for i := range rcpt {
+		smtputf8 = smtputf8 || !isASCII(rcpt[i])
+	}
+	if ok, _ := s.Extension("SMTPUTF8"); smtputf8 && !ok {
+		setRcptErr(results, rcpt, &SMTPError{Code: 553, EnhancedCode: "5.6.7", Message: "non-ASCII address is not permitted, server does not support SMTPUTF8", Stage: StageMail, Host: s.host})
+		return true
 	}
 
-	if auth != nil {
-		if err = client.Auth(auth); err != nil {
-			return err
+	chunking, _ := s.Extension("CHUNKING")
+	body := e.bodyType(s, chunking)
+	var params []string
+	if body == BodyBinaryMIME {
+		params = append(params, "BODY=BINARYMIME")
+	} else if ok, _ := s.Extension("8BITMIME"); ok {
+		params = append(params, "BODY=8BITMIME")
+	}
+	if smtputf8 {
+		params = append(params, "SMTPUTF8")
+	}
+	if ok, limit := s.Extension("SIZE"); ok && e.Size > 0 {
+		if max, err := strconv.Atoi(limit); err == nil && max > 0 && e.Size > max {
+			setRcptErr(results, rcpt, &SMTPError{Code: 552, EnhancedCode: "5.3.4", Message: fmt.Sprintf("message size %d exceeds server limit %d", e.Size, max), Stage: StageMail, Host: s.host})
+			return true
+		}
+		params = append(params, "SIZE="+strconv.Itoa(e.Size))
+	}
+	rcptParams := make([][]string, len(rcpt))
+	if dsn, _ := s.Extension("DSN"); dsn && e.DSN != nil {
+		params = append(params, e.DSN.mailParams()...)
+		for i := range rcpt {
+			rcptParams[i] = e.DSN.rcptParams(rcpt[i])
 		}
 	}
 
-	if err := client.Mail(e.from()); err != nil {
-		return err
+	// with PIPELINING MAIL FROM, RCPT TO and DATA are sent in one write, then replies are read in order
+	pipelining, _ := s.Extension("PIPELINING")
+	pipeData := pipelining && !chunking
+	if pipelining {
+		if err := e.pipeline(s, rcpt, params, rcptParams, pipeData); err != nil {
+			setRcptErr(results, rcpt, newSMTPError(StageMail, s.host, ctxErr(ctx, err)))
+			return isReply(err)
+		}
 	}
 
-	if err := client.Rcpt(e.to()); err != nil {
-		return err
+	var err error
+	if pipelining {
+		_, _, err = s.reply(250)
+	} else {
+		err = s.Mail(e.from(), params...)
+	}
+	if err != nil {
+		setRcptErr(results, rcpt, newSMTPError(StageMail, s.host, ctxErr(ctx, err)))
+		if !isReply(err) {
+			return false
+		}
+		if pipelining {
+			return s.discardReplies(len(rcpt), pipeData)
+		}
+		return true
 	}
 
-	defer func() {
-		_ = client.Quit()
-		_ = client.Close()
-	}()
+	var accepted []string
+	for i := range rcpt {
+		_ = s.conn.timeout(s.timeouts.Rcpt)
+		// own err, rejected last recipient must not fail message data
+		var err error
+		if pipelining {
+			_, _, err = s.reply(25)
+		} else {
+			err = s.Rcpt(rcpt[i], rcptParams[i]...)
+		}
+		if err != nil {
+			if !isReply(err) {
+				setRcptErr(results, rcpt, newSMTPError(StageRcpt, s.host, ctxErr(ctx, err)))
+				return false
+			}
+			results[rcpt[i]] = newSMTPError(StageRcpt, s.host, err)
+			continue
+		}
+		accepted = append(accepted, rcpt[i])
+	}
+
+	_ = s.conn.timeout(s.timeouts.DataInit)
+	var w *dataCloser
+	switch {
+	case pipeData:
+		w, err = s.PipelineData(len(accepted) != 0)
+	case len(accepted) == 0:
+	case chunking:
+		w = s.Bdat(body != BodyBinaryMIME)
+	default:
+		w, err = s.Data()
+	}
+	if len(accepted) == 0 {
+		return err == nil || isReply(err)
+	}
+	if err != nil {
+		setRcptErr(results, accepted, newSMTPError(StageData, s.host, ctxErr(ctx, err)))
+		return isReply(err)
+	}
 
-	w, err := client.Data()
+	dw := &dataWriter{WriteCloser: w, conn: s.conn, timeouts: s.timeouts}
+	if body != "" {
+		err = e.bodyWriter(dw, body)
+	} else {
+		err = e.WriteCloser(dw)
+	}
+	if err == nil {
+		// close if write function did not, else return its close error
+		err = dw.Close()
+	}
+	if err != nil {
+		setRcptErr(results, accepted, newSMTPError(StageData, s.host, ctxErr(ctx, err)))
+		return isReply(err)
+	}
+	setRcptErr(results, accepted, nil)
+	s.describe(res)
+	res.Reply = w.reply
+	res.Size = w.size
+	return true
+}
+
+// pipeline send MAIL FROM, RCPT TO for every recipient and DATA if data in one write
+func (e *Email) pipeline(s *session, rcpt []string, params []string, rcptParams [][]string, data bool) error {
+	line, err := mailLine(e.from(), params)
 	if err != nil {
 		return err
 	}
+	lines := make([]string, 0, len(rcpt)+2)
+	lines = append(lines, line)
+	for i := range rcpt {
+		if line, err = rcptLine(rcpt[i], rcptParams[i]); err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if data {
+		lines = append(lines, "DATA")
+	}
+	return s.Pipeline(lines)
+}
+
+// bodyType return BINARYMIME or 8BITMIME if email can be rendered with it and server supports it,
+// else empty for 7bit body
+func (e *Email) bodyType(s *session, chunking bool) string {
+	if e.bodyWriter == nil {
+		return ""
+	}
+	if binary, _ := s.Extension("BINARYMIME"); binary && chunking && e.body == BodyBinaryMIME {
+		return BodyBinaryMIME
+	}
+	if ok, _ := s.Extension("8BITMIME"); ok {
+		return Body8BitMIME
+	}
+	return ""
+}
+
+// tlsOptions return TLS options for this email, DontUseTLS disable STARTTLS
+func (e *Email) tlsOptions(options TLSOptions) TLSOptions {
+	if e.DontUseTLS {
+		options.Policy = TLSNone
+	}
+	return options
+}
+
+// isReply true if err is SMTP server reply and session is still usable
+func isReply(err error) bool {
+	_, ok := err.(*textproto.Error)
+	return ok
+}
+
+// result set res duration and recipients in envelope order
+func (e *Email) result(res *Result, results map[string]error, start time.Time) {
+	res.Duration = time.Since(start)
+	for _, rcpt := range e.recipients {
+		res.Rcpt = append(res.Rcpt, RcptResult{Email: rcpt, Err: results[rcpt]})
+	}
+	res.Err = rcptErr(res.Rcpt)
+}
+
+// rcptErr return nil if one or more recipients accepted, else first recipient error
+func rcptErr(rcpt []RcptResult) error {
+	var err error
+	for i := range rcpt {
+		if rcpt[i].Err == nil {
+			return nil
+		}
+		if err == nil {
+			err = rcpt[i].Err
+		}
+	}
+	return err
+}
+
+func setRcptErr(results map[string]error, rcpt []string, err error) {
+	for i := range rcpt {
+		results[rcpt[i]] = err
+	}
+}
 
-	return e.WriteCloser(w)
+// rcptByDomain group envelope recipients by domain in envelope order
+func (e *Email) rcptByDomain() (domains []string, rcpt map[string][]string) {
+	rcpt = map[string][]string{}
+	for _, r := range e.recipients {
+		domain := r[strings.LastIndex(r, "@")+1:]
+		if _, ok := rcpt[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcpt[domain] = append(rcpt[domain], r)
+	}
+	return
+}
+
+// context return context from Pipe.SendContext
+func (e *Email) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
 }
 
 func (e *Email) from() string {
@@ -138,13 +425,33 @@ func (e *Email) parseEmail() (err error) {
 	if err != nil {
 		return fmt.Errorf("Field From has %s", err)
 	}
-	e.toName, e.toEmail, e.toDomain, err = splitEmail(e.To)
-	if err != nil {
-		return fmt.Errorf("Field To has %s", err)
+	e.recipients = nil
+	if e.To != "" || len(e.Recipients) == 0 {
+		e.toName, e.toEmail, e.toDomain, err = splitEmail(e.To)
+		if err != nil {
+			return fmt.Errorf("Field To has %s", err)
+		}
+		e.addRecipient(e.to())
+	}
+	for i := range e.Recipients {
+		_, email, domain, err := splitEmail(e.Recipients[i])
+		if err != nil {
+			return fmt.Errorf("Field Recipients has %s", err)
+		}
+		e.addRecipient(email + "@" + domain)
 	}
 	return
 }
 
+func (e *Email) addRecipient(rcpt string) {
+	for i := range e.recipients {
+		if e.recipients[i] == rcpt {
+			return
+		}
+	}
+	e.recipients = append(e.recipients, rcpt)
+}
+
 var (
 	splitEmailFullStringRe = regexp.MustCompile(`(.+)<(.+)@(.+\..{2,12})>`)
 	splitEmailOnlyStringRe = regexp.MustCompile(`<(.+)@(.+\..{2,12})>`)
@@ -164,19 +471,39 @@ func splitEmail(e string) (name, email, domain string, err error) {
 	//email = strings.TrimSpace(split[0])
 	//domain = strings.TrimRight(strings.ToLower(strings.TrimSpace(split[1])), ".")
 
+	if !utf8.ValidString(e) {
+		return "", "", "", fmt.Errorf("bad email format")
+	}
 	s := strings.TrimSpace(e)
+	// local part is case sensitive and kept as given, only domain is lowercased
 	if m := splitEmailFullStringRe.FindStringSubmatch(s); len(m) == 4 {
 		name = strings.TrimSpace(m[1])
-		email = strings.ToLower(strings.TrimSpace(m[2]))
+		email = strings.TrimSpace(m[2])
 		domain = strings.TrimRight(strings.ToLower(strings.TrimSpace(m[3])), ".")
 	} else if m := splitEmailOnlyStringRe.FindStringSubmatch(s); len(m) == 3 {
-		email = strings.ToLower(strings.TrimSpace(m[1]))
+		email = strings.TrimSpace(m[1])
 		domain = strings.TrimRight(strings.ToLower(strings.TrimSpace(m[2])), ".")
 	} else if m := splitEmailRe.FindStringSubmatch(s); len(m) == 3 {
-		email = strings.ToLower(strings.TrimSpace(m[1]))
+		email = strings.TrimSpace(m[1])
 		domain = strings.TrimRight(strings.ToLower(strings.TrimSpace(m[2])), ".")
 	} else {
-		err = fmt.Errorf("bad email format")
+		return "", "", "", fmt.Errorf("bad email format")
+	}
+	if !isASCII(domain) {
+		// IDN domain in punycode for DNS lookup and envelope
+		if domain, err = idna.Lookup.ToASCII(domain); err != nil {
+			return "", "", "", fmt.Errorf("bad email domain: %s", err)
+		}
 	}
 	return
 }
+
+// isASCII true if s has only ASCII characters, else address needs SMTPUTF8
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -13,13 +13,17 @@ var (
 
 func init() {
 	rightEmail = append(rightEmail, emailField{" My name   <  my+email@domain.tld.  > ", "My name", "my+email", "domain.tld"})
-	rightEmail = append(rightEmail, emailField{"  < My+Email@doMain.tld.  >  ", "", "my+email", "domain.tld"})
-	rightEmail = append(rightEmail, emailField{"  mY+eMail@Domain.Tld.   ", "", "my+email", "domain.tld"})
+	rightEmail = append(rightEmail, emailField{"  < My+Email@doMain.tld.  >  ", "", "My+Email", "domain.tld"})
+	rightEmail = append(rightEmail, emailField{"  mY+eMail@Domain.Tld.   ", "", "mY+eMail", "domain.tld"})
 	rightEmail = append(rightEmail, emailField{"recipient@linklocal.supme.ru", "", "recipient", "linklocal.supme.ru"})
+	rightEmail = append(rightEmail, emailField{"Получатель <Получатель@Пример.РФ>", "Получатель", "Получатель", "xn--e1afmkfd.xn--p1ai"})
+	rightEmail = append(rightEmail, emailField{"user@bücher.de", "", "user", "xn--bcher-kva.de"})
 	rightEmail = append(rightEmail, emailField{"=?utf-8?q?=D0=9E=D1=82=D0=BF=D1=80=D0=B0=D0=B2=D0=B8=D1=82=D0=B5=D0=BB?= =?utf-8?q?=D1=8C?= <sender@localhost.localdomain>", "=?utf-8?q?=D0=9E=D1=82=D0=BF=D1=80=D0=B0=D0=B2=D0=B8=D1=82=D0=B5=D0=BB?= =?utf-8?q?=D1=8C?=", "sender", "localhost.localdomain"})
 
 	badEmail = append(badEmail, emailField{input: "my+email@domain.t"})
 	badEmail = append(badEmail, emailField{input: "< my+email[at]domain.tld>"})
+	badEmail = append(badEmail, emailField{input: "user\xff@domain.tld"})
+	badEmail = append(badEmail, emailField{input: "user@xn--a.рф"})
 	//badEmail = append(badEmail, emailField{input: "<my+email@domain.tld."})
 }
 
@@ -0,0 +1,111 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+)
+
+// SMTP stages for SMTPError
+const (
+	StageParse    = "parse"
+	StageLookup   = "lookup"
+	StageDial     = "dial"
+	StageGreeting = "greeting"
+	StageEHLO     = "ehlo"
+	StageStartTLS = "starttls"
+	StageMTASTS   = "mta-sts"
+	StageDANE     = "dane"
+	StageAuth     = "auth"
+	StageMail     = "mail"
+	StageRcpt     = "rcpt"
+	StageData     = "data"
+)
+
+// SMTPError send error with SMTP reply code
+type SMTPError struct {
+	// Code SMTP reply code, 421 for connection errors
+	Code int
+	// EnhancedCode RFC 3463 enhanced status code like "5.1.1", empty if server did not send it
+	EnhancedCode string
+	// Message reply text without codes
+	Message string
+	// Stage where error occurred
+	Stage string
+	// Host MX or SMTP server host name
+	Host string
+	// Err underlying error
+	Err error
+}
+
+// Error return string with reply code at begin, example "550 5.1.1 User unknown (rcpt mx.domain.tld)"
+func (e *SMTPError) Error() string {
+	s := strconv.Itoa(e.Code)
+	if e.EnhancedCode != "" {
+		s += " " + e.EnhancedCode
+	}
+	s += " " + e.Message
+	if e.Host != "" {
+		return fmt.Sprintf("%s (%s %s)", s, e.Stage, e.Host)
+	}
+	return fmt.Sprintf("%s (%s)", s, e.Stage)
+}
+
+// Unwrap return underlying error
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary is true for 4xx reply codes, email can be resent later
+func (e *SMTPError) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s*`)
+
+// newSMTPError make SMTPError from server reply or other error.
+// Not reply errors before mail transaction, network and context errors get code 421,
+// other errors get 554.
+func newSMTPError(stage, host string, err error) *SMTPError {
+	var e *SMTPError
+	if errors.As(err, &e) {
+		return e
+	}
+	e = &SMTPError{Stage: stage, Host: host, Err: err}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		e.Code = reply.Code
+		e.Message = reply.Msg
+		if m := enhancedCodeRe.FindStringSubmatch(reply.Msg); m != nil {
+			e.EnhancedCode = m[1]
+			e.Message = reply.Msg[len(m[0]):]
+		}
+		return e
+	}
+	e.Message = err.Error()
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		e.Code = 421
+		return e
+	}
+	switch stage {
+	case StageLookup, StageDial, StageGreeting, StageEHLO, StageStartTLS:
+		e.Code = 421
+	default:
+		if isNetError(err) {
+			e.Code = 421
+		} else {
+			e.Code = 554
+		}
+	}
+	return e
+}
+
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
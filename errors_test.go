@@ -0,0 +1,44 @@
+package smtpSender
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+func TestNewSMTPError(t *testing.T) {
+	tests := []struct {
+		stage, host string
+		err         error
+		code        int
+		enhanced    string
+		message     string
+		temporary   bool
+		text        string
+	}{
+		{StageRcpt, "mx.domain.tld", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}, 550, "5.1.1", "User unknown", false, "550 5.1.1 User unknown (rcpt mx.domain.tld)"},
+		{StageMail, "mx.domain.tld", &textproto.Error{Code: 451, Msg: "Greylisted"}, 451, "", "Greylisted", true, "451 Greylisted (mail mx.domain.tld)"},
+		{StageDial, "mx.domain.tld", errors.New("connection refused"), 421, "", "connection refused", true, "421 connection refused (dial mx.domain.tld)"},
+		{StageData, "mx.domain.tld", io.EOF, 421, "", "EOF", true, "421 EOF (data mx.domain.tld)"},
+		{StageData, "", errors.New("open file: not found"), 554, "", "open file: not found", false, "554 open file: not found (data)"},
+	}
+	for _, test := range tests {
+		e := newSMTPError(test.stage, test.host, test.err)
+		if e.Code != test.code || e.EnhancedCode != test.enhanced || e.Message != test.message {
+			t.Errorf("error '%v' parsed as %d '%s' '%s'", test.err, e.Code, e.EnhancedCode, e.Message)
+		}
+		if e.Temporary() != test.temporary {
+			t.Errorf("error '%v' temporary is %t", test.err, e.Temporary())
+		}
+		if e.Error() != test.text {
+			t.Errorf("error text '%s', want '%s'", e.Error(), test.text)
+		}
+		if !errors.Is(e, test.err) {
+			t.Errorf("error '%v' not unwrapped", test.err)
+		}
+		if newSMTPError(StageData, "other", e) != e {
+			t.Errorf("error '%v' wrapped twice", test.err)
+		}
+	}
+}
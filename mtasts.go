@@ -0,0 +1,241 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mtaSTSMaxPolicySize = 64 * 1024
+	mtaSTSMaxAge        = 31557600
+	mtaSTSFetchTimeout  = time.Minute
+	// mtaSTSFailureTTL policy is not fetched again for the same TXT record id after failure
+	mtaSTSFailureTTL = 5 * time.Minute
+)
+
+// MTA-STS policy modes
+const (
+	MTASTSEnforce = "enforce"
+	MTASTSTesting = "testing"
+	MTASTSNone    = "none"
+)
+
+// MTASTSFetcher fetch MTA-STS policy file of domain
+type MTASTSFetcher interface {
+	FetchPolicy(ctx context.Context, domain string) ([]byte, error)
+}
+
+// HTTPFetcher fetch policy from https://mta-sts.<domain>/.well-known/mta-sts.txt
+type HTTPFetcher struct {
+	// Client for fetch, redirects must not be followed. Default client with 1 minute timeout
+	Client *http.Client
+}
+
+// FetchPolicy return policy file of domain
+func (f HTTPFetcher) FetchPolicy(ctx context.Context, domain string) ([]byte, error) {
+	client := f.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: mtaSTSFetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch MTA-STS policy: %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, fmt.Errorf("fetch MTA-STS policy: wrong content type %s", resp.Header.Get("Content-Type"))
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, mtaSTSMaxPolicySize))
+}
+
+// MTASTS RFC 8461 policies of recipient domains with cache, safe for concurrent use.
+// In enforce mode email is delivered only to MX hosts matched policy over verified TLS.
+// Failed policy fetch is not repeated for the same TXT record id for 5 minutes.
+type MTASTS struct {
+	fetcher  MTASTSFetcher
+	mu       sync.Mutex
+	policies map[string]*mtaSTSPolicy
+	failures map[string]mtaSTSFailure
+}
+
+// mtaSTSFailure failed fetch or parse of policy with TXT record id
+type mtaSTSFailure struct {
+	id     string
+	expire time.Time
+}
+
+// NewMTASTS return MTA-STS policies cache, nil fetcher use HTTPFetcher
+func NewMTASTS(fetcher MTASTSFetcher) *MTASTS {
+	if fetcher == nil {
+		fetcher = HTTPFetcher{}
+	}
+	return &MTASTS{fetcher: fetcher, policies: map[string]*mtaSTSPolicy{}, failures: map[string]mtaSTSFailure{}}
+}
+
+// mtaSTSPolicy parsed policy
+type mtaSTSPolicy struct {
+	id     string
+	mode   string
+	mx     []string
+	expire time.Time
+}
+
+// policy return actual policy of domain or nil if domain has not policy
+func (s *MTASTS) policy(ctx context.Context, r Resolver, domain string) *mtaSTSPolicy {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	s.mu.Lock()
+	cached := s.policies[domain]
+	failure := s.failures[domain]
+	s.mu.Unlock()
+	if cached != nil && time.Now().After(cached.expire) {
+		cached = nil
+	}
+
+	txts, err := r.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return cached
+	}
+	id, ok := mtaSTSRecordID(txts)
+	if !ok {
+		return cached
+	}
+	if cached != nil && cached.id == id {
+		return cached
+	}
+	// recently failed policy of this id is not fetched for every email
+	if failure.id == id && time.Now().Before(failure.expire) {
+		return cached
+	}
+
+	data, err := s.fetcher.FetchPolicy(ctx, domain)
+	var p *mtaSTSPolicy
+	if err == nil {
+		p, err = parseMTASTSPolicy(data)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// canceled fetch is not a policy failure
+		if ctx.Err() == nil {
+			s.failures[domain] = mtaSTSFailure{id: id, expire: time.Now().Add(mtaSTSFailureTTL)}
+		}
+		return cached
+	}
+	p.id = id
+	s.policies[domain] = p
+	delete(s.failures, domain)
+	return p
+}
+
+// mtaSTSRecordID return id of the only valid TXT record
+func mtaSTSRecordID(txts []string) (id string, ok bool) {
+	var found int
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1;") {
+			continue
+		}
+		found++
+		for _, field := range strings.Split(txt, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	return id, found == 1 && id != ""
+}
+
+// parseMTASTSPolicy parse policy file
+func parseMTASTSPolicy(data []byte) (*mtaSTSPolicy, error) {
+	p := &mtaSTSPolicy{}
+	var version string
+	maxAge := -1
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "version":
+			version = value
+		case "mode":
+			p.mode = value
+		case "mx":
+			p.mx = append(p.mx, strings.ToLower(value))
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 {
+				return nil, fmt.Errorf("wrong MTA-STS max_age %s", value)
+			}
+			maxAge = age
+		}
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("wrong MTA-STS version %s", version)
+	}
+	if p.mode != MTASTSEnforce && p.mode != MTASTSTesting && p.mode != MTASTSNone {
+		return nil, fmt.Errorf("wrong MTA-STS mode %s", p.mode)
+	}
+	if maxAge < 0 {
+		return nil, errors.New("MTA-STS max_age not set")
+	}
+	if len(p.mx) == 0 && p.mode != MTASTSNone {
+		return nil, errors.New("MTA-STS mx not set")
+	}
+	if maxAge > mtaSTSMaxAge {
+		maxAge = mtaSTSMaxAge
+	}
+	p.expire = time.Now().Add(time.Duration(maxAge) * time.Second)
+	return p, nil
+}
+
+// enforce true if policy must be enforced
+func (p *mtaSTSPolicy) enforce() bool {
+	return p != nil && p.mode == MTASTSEnforce
+}
+
+// match true if MX host match policy mx patterns, "*." match one left label
+func (p *mtaSTSPolicy) match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.mx {
+		if strings.HasPrefix(mx, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i+1:] == mx[2:] {
+				return true
+			}
+		} else if host == mx {
+			return true
+		}
+	}
+	return false
+}
+
+// error return policy failure error for MX host
+func (p *mtaSTSPolicy) error(host string, err error) *SMTPError {
+	if err == nil {
+		return &SMTPError{Code: 421, EnhancedCode: "4.7.0", Message: "MX host does not match MTA-STS policy", Stage: StageMTASTS, Host: host}
+	}
+	return &SMTPError{Code: 421, EnhancedCode: "4.7.5", Message: "MTA-STS policy requires verified TLS: " + err.Error(), Stage: StageMTASTS, Host: host, Err: err}
+}
@@ -0,0 +1,140 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	p, err := parseMTASTSPolicy([]byte("version: STSv1\r\nmode: enforce\r\nmx: mail.domain.tld\r\nmx: *.domain.tld\r\nmax_age: 604800\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.enforce() || len(p.mx) != 2 || time.Until(p.expire) < 604700*time.Second {
+		t.Errorf("wrong parsed policy %+v", p)
+	}
+	for host, match := range map[string]bool{
+		"mail.domain.tld":      true,
+		"MX1.Domain.tld.":      true,
+		"domain.tld":           false,
+		"a.mx1.domain.tld":     false,
+		"mail.otherdomain.tld": false,
+	} {
+		if p.match(host) != match {
+			t.Errorf("host %s match %t, want %t", host, !match, match)
+		}
+	}
+
+	for _, policy := range []string{
+		"version: STSv2\nmode: enforce\nmx: mail.domain.tld\nmax_age: 86400\n",
+		"version: STSv1\nmode: always\nmx: mail.domain.tld\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmx: mail.domain.tld\n",
+	} {
+		if _, err := parseMTASTSPolicy([]byte(policy)); err == nil {
+			t.Errorf("wrong policy parsed: %q", policy)
+		}
+	}
+}
+
+func TestMTASTSRecordID(t *testing.T) {
+	tests := []struct {
+		txts []string
+		id   string
+		ok   bool
+	}{
+		{[]string{"v=STSv1; id=20160831085700Z;"}, "20160831085700Z", true},
+		{[]string{"v=spf1 -all", "v=STSv1; id=1"}, "1", true},
+		{[]string{"v=STSv1; id=1", "v=STSv1; id=2"}, "", false},
+		{[]string{"v=STSv1;"}, "", false},
+	}
+	for _, test := range tests {
+		if id, ok := mtaSTSRecordID(test.txts); ok != test.ok || (ok && id != test.id) {
+			t.Errorf("records %v return id '%s' %t", test.txts, id, ok)
+		}
+	}
+}
+
+// countFetcher count fetches of policy
+type countFetcher struct {
+	fetches int
+}
+
+func (f *countFetcher) FetchPolicy(ctx context.Context, domain string) ([]byte, error) {
+	f.fetches++
+	return []byte("version: STSv1\nmode: enforce\nmx: mail.domain.tld\nmax_age: 86400\n"), nil
+}
+
+// txtResolver return TXT records from map
+type txtResolver struct {
+	countResolver
+	txt map[string][]string
+}
+
+func (r *txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.txt[name], nil
+}
+
+func TestMTASTSCache(t *testing.T) {
+	f := &countFetcher{}
+	r := &txtResolver{txt: map[string][]string{"_mta-sts.domain.tld": {"v=STSv1; id=1"}}}
+	sts := NewMTASTS(f)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if p := sts.policy(ctx, r, "domain.tld"); !p.enforce() {
+			t.Fatalf("policy not found")
+		}
+	}
+	if f.fetches != 1 {
+		t.Errorf("policy fetched %d times, want 1", f.fetches)
+	}
+
+	r.txt["_mta-sts.domain.tld"] = []string{"v=STSv1; id=2"}
+	sts.policy(ctx, r, "domain.tld")
+	if f.fetches != 2 {
+		t.Errorf("policy with new id fetched %d times, want 2", f.fetches)
+	}
+
+	delete(r.txt, "_mta-sts.domain.tld")
+	if p := sts.policy(ctx, r, "domain.tld"); !p.enforce() {
+		t.Error("cached policy not used without TXT record")
+	}
+	if p := sts.policy(ctx, r, "other.tld"); p != nil {
+		t.Errorf("domain without TXT record has policy %+v", p)
+	}
+}
+
+// failFetcher count fetches and fail
+type failFetcher struct {
+	fetches int
+}
+
+func (f *failFetcher) FetchPolicy(ctx context.Context, domain string) ([]byte, error) {
+	f.fetches++
+	return nil, errors.New("connection refused")
+}
+
+func TestMTASTSCacheFailure(t *testing.T) {
+	f := &failFetcher{}
+	r := &txtResolver{txt: map[string][]string{"_mta-sts.domain.tld": {"v=STSv1; id=1"}}}
+	sts := NewMTASTS(f)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if p := sts.policy(ctx, r, "domain.tld"); p != nil {
+			t.Fatalf("failed policy return %+v", p)
+		}
+	}
+	if f.fetches != 1 {
+		t.Errorf("failed policy fetched %d times, want 1", f.fetches)
+	}
+
+	r.txt["_mta-sts.domain.tld"] = []string{"v=STSv1; id=2"}
+	sts.policy(ctx, r, "domain.tld")
+	if f.fetches != 2 {
+		t.Errorf("policy with new id fetched %d times, want 2", f.fetches)
+	}
+}
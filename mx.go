@@ -0,0 +1,122 @@
+package smtpSender
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resolver DNS resolver for MX, A/AAAA, PTR and TXT lookups, *net.Resolver implements it
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// resolveMX return MX hosts of domain sorted by preference, hosts with equal preference are shuffled.
+// If domain has not MX records, domain itself is returned as implicit MX (RFC 5321 5.1).
+// Null MX (RFC 7505) and not existing domain return permanent error.
+func resolveMX(ctx context.Context, r Resolver, domain string, tries int) ([]*net.MX, error) {
+	var (
+		mxs []*net.MX
+		err error
+	)
+	err = retryLookup(ctx, tries, func() error {
+		mxs, err = r.LookupMX(ctx, domain)
+		return err
+	})
+	if err != nil && !isNotFound(err) {
+		return nil, lookupError(ctx, domain, err)
+	}
+
+	if len(mxs) == 0 {
+		var addrs []string
+		err = retryLookup(ctx, tries, func() error {
+			addrs, err = r.LookupHost(ctx, domain)
+			return err
+		})
+		if err != nil && !isNotFound(err) {
+			return nil, lookupError(ctx, domain, err)
+		}
+		if len(addrs) == 0 {
+			return nil, &SMTPError{Code: 550, EnhancedCode: "5.1.2", Message: "domain not found", Stage: StageLookup, Host: domain, Err: err}
+		}
+		return []*net.MX{{Host: domain, Pref: 0}}, nil
+	}
+
+	var hosts []*net.MX
+	for _, mx := range mxs {
+		if strings.TrimSpace(mx.Host) != "." {
+			hosts = append(hosts, mx)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, &SMTPError{Code: 556, EnhancedCode: "5.1.10", Message: "domain does not accept mail (null MX)", Stage: StageLookup, Host: domain}
+	}
+	sortMX(hosts)
+	return hosts, nil
+}
+
+// resolveHost return IP addresses of MX host
+func resolveHost(ctx context.Context, r Resolver, host string, tries int) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	var (
+		addrs []string
+		err   error
+	)
+	err = retryLookup(ctx, tries, func() error {
+		addrs, err = r.LookupHost(ctx, host)
+		return err
+	})
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, newSMTPError(StageLookup, host, ctxErr(ctx, err))
+	}
+	return addrs, nil
+}
+
+// retryLookup call lookup up to tries times while it return temporary error
+func retryLookup(ctx context.Context, tries int, lookup func() error) (err error) {
+	for try := 1; try <= tries; try++ {
+		if err = lookup(); err == nil || isNotFound(err) {
+			return err
+		}
+		if try != tries && sleepContext(ctx, time.Second) != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// lookupError return temporary error of failed lookup
+func lookupError(ctx context.Context, domain string, err error) error {
+	if ctx.Err() != nil {
+		return newSMTPError(StageLookup, domain, ctx.Err())
+	}
+	return &SMTPError{Code: 421, Message: "max MX lookup tries reached", Stage: StageLookup, Host: domain, Err: err}
+}
+
+// isNotFound true if DNS server answered that domain or records not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// sortMX sort by preference and shuffle hosts with equal preference
+func sortMX(mxs []*net.MX) {
+	rand.Shuffle(len(mxs), func(i, j int) {
+		mxs[i], mxs[j] = mxs[j], mxs[i]
+	})
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+}
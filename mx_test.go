@@ -0,0 +1,28 @@
+package smtpSender
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortMX(t *testing.T) {
+	mxs := []*net.MX{
+		{Host: "mx30.domain.tld", Pref: 30},
+		{Host: "mx10a.domain.tld", Pref: 10},
+		{Host: "mx20.domain.tld", Pref: 20},
+		{Host: "mx10b.domain.tld", Pref: 10},
+	}
+	first := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		sortMX(mxs)
+		for j := 1; j < len(mxs); j++ {
+			if mxs[j-1].Pref > mxs[j].Pref {
+				t.Fatalf("MX %s with preference %d before %d", mxs[j-1].Host, mxs[j-1].Pref, mxs[j].Pref)
+			}
+		}
+		first[mxs[0].Host] = true
+	}
+	if !first["mx10a.domain.tld"] || !first["mx10b.domain.tld"] {
+		t.Errorf("MX with equal preference not shuffled: %v", first)
+	}
+}
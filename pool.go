@@ -0,0 +1,205 @@
+package smtpSender
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionIdle = 30 * time.Second
+	// quitTimeout max wait for QUIT reply, message is already sent or failed
+	quitTimeout = 10 * time.Second
+)
+
+// session SMTP connection ready for mail transaction
+type session struct {
+	*smtpClient
+	conn     *timeoutConn
+	timeouts Timeouts
+	key      string
+	host     string
+	remoteIP string
+	localIP  string
+	proxy    string
+	messages int
+	idle     time.Time
+}
+
+// describe set session delivery fields to res
+func (s *session) describe(res *Result) {
+	res.Host = s.host
+	res.RemoteIP = s.remoteIP
+	res.LocalIP = s.localIP
+	res.Proxy = s.proxy
+	res.HeloName = s.localName
+	res.TLSVersion, res.TLSCipher = "", ""
+	if state, ok := s.TLSConnectionState(); ok {
+		res.TLSVersion = tlsVersionName(state.Version)
+		res.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	res.Auth = s.mech
+	res.Reply = ""
+	res.Size = 0
+}
+
+// quit send QUIT with short deadline and close session
+func (s *session) quit() {
+	d := s.timeouts.Command
+	if d > quitTimeout {
+		d = quitTimeout
+	}
+	_ = s.conn.timeout(d)
+	_ = s.Quit()
+	_ = s.Close()
+}
+
+// sessionPool keeps opened SMTP sessions for reuse
+type sessionPool struct {
+	mu          sync.Mutex
+	maxMessages int
+	idleTimeout time.Duration
+	idle        map[string][]*session
+	closed      bool
+	done        chan struct{}
+}
+
+func newSessionPool(maxMessages int, idleTimeout time.Duration) *sessionPool {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSessionIdle
+	}
+	p := &sessionPool{
+		maxMessages: maxMessages,
+		idleTimeout: idleTimeout,
+		idle:        map[string][]*session{},
+		done:        make(chan struct{}),
+	}
+	go p.cleaner()
+	return p
+}
+
+// get return idle session for key reset with RSET or nil if pool has not alive session
+func (p *sessionPool) get(key string) *session {
+	for {
+		p.mu.Lock()
+		list := p.idle[key]
+		if len(list) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		s := list[len(list)-1]
+		if len(list) == 1 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = list[:len(list)-1]
+		}
+		p.mu.Unlock()
+
+		if time.Since(s.idle) < p.idleTimeout && s.conn.timeout(s.timeouts.Command) == nil && s.Reset() == nil {
+			return s
+		}
+		_ = s.Close()
+	}
+}
+
+// put return session to pool after sent email, false if session must be closed
+func (p *sessionPool) put(s *session) bool {
+	s.messages++
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// idle session must not hold connection slot other connection waits for
+	if p.closed || s.messages >= p.maxMessages || s.conn.limit.waiting() {
+		return false
+	}
+	s.idle = time.Now()
+	p.idle[s.key] = append(p.idle[s.key], s)
+	return true
+}
+
+// closeLimit quit the oldest idle session holding connection slot of l, false if there is no such session
+func (p *sessionPool) closeLimit(l *limit) bool {
+	if p == nil {
+		return false
+	}
+	var (
+		oldest *session
+		key    string
+		index  int
+	)
+	p.mu.Lock()
+	for k, list := range p.idle {
+		for i, s := range list {
+			if s.conn.limit == l && (oldest == nil || s.idle.Before(oldest.idle)) {
+				oldest, key, index = s, k, i
+			}
+		}
+	}
+	if oldest != nil {
+		list := append(p.idle[key][:index], p.idle[key][index+1:]...)
+		if len(list) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = list
+		}
+	}
+	p.mu.Unlock()
+
+	if oldest == nil {
+		return false
+	}
+	oldest.quit()
+	return true
+}
+
+func (p *sessionPool) cleaner() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.closeIdle(false)
+		}
+	}
+}
+
+// closeIdle quit sessions idle longer than timeout or all idle sessions
+func (p *sessionPool) closeIdle(all bool) {
+	var expired []*session
+	p.mu.Lock()
+	for key, list := range p.idle {
+		n := 0
+		for _, s := range list {
+			if all || time.Since(s.idle) >= p.idleTimeout {
+				expired = append(expired, s)
+			} else {
+				list[n] = s
+				n++
+			}
+		}
+		if n == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = list[:n]
+		}
+	}
+	p.mu.Unlock()
+
+	for _, s := range expired {
+		s.quit()
+	}
+}
+
+// close quit all idle sessions, sessions returned after close are not kept
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+	p.closeIdle(true)
+}
@@ -0,0 +1,162 @@
+package smtpSender
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit limit sending to recipient domains or MX hosts matched Pattern.
+// Limit is shared by all domains and hosts matched the rule. With SMTPserver
+// rule is matched by recipient domains of email and relay host.
+type RateLimit struct {
+	// Pattern recipient domain or MX host, "*" match any characters,
+	// for example "gmail.com", "*.google.com" or "*"
+	Pattern string
+	// Messages max messages per Per interval, 0 unlimited
+	Messages int
+	// Per interval for Messages. Default 1 second
+	Per time.Duration
+	// Connections max concurrent connections, 0 unlimited. Idle pooled session is closed
+	// if new connection waits for its slot
+	Connections int
+}
+
+// rateLimiter rate limits for one Config, first matched rule is used
+type rateLimiter struct {
+	limits []*limit
+}
+
+// limit state of one rule
+type limit struct {
+	rule     RateLimit
+	interval time.Duration
+	conns    chan struct{}
+	waiters  int32
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// newRateLimiter return limiter for rules or nil if rules empty
+func newRateLimiter(rules []RateLimit) *rateLimiter {
+	if len(rules) == 0 {
+		return nil
+	}
+	r := &rateLimiter{}
+	for _, rule := range rules {
+		l := &limit{}
+		rule.Pattern = strings.ToLower(rule.Pattern)
+		if rule.Messages > 0 {
+			if rule.Per <= 0 {
+				rule.Per = time.Second
+			}
+			l.interval = rule.Per / time.Duration(rule.Messages)
+		}
+		if rule.Connections > 0 {
+			l.conns = make(chan struct{}, rule.Connections)
+		}
+		l.rule = rule
+		r.limits = append(r.limits, l)
+	}
+	return r
+}
+
+// match return limit of first rule matched one of recipient domains or MX host, nil if no rule matched
+func (r *rateLimiter) match(host string, domains ...string) *limit {
+	if r == nil {
+		return nil
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, l := range r.limits {
+		for _, domain := range domains {
+			if ok, _ := path.Match(l.rule.Pattern, strings.ToLower(domain)); ok {
+				return l
+			}
+		}
+		if ok, _ := path.Match(l.rule.Pattern, host); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+// deliveryLimits rate limits state of one email delivery
+type deliveryLimits struct {
+	// domains recipient domains matched by rules
+	domains []string
+	waited  map[*limit]bool
+}
+
+func newDeliveryLimits(domains ...string) *deliveryLimits {
+	return &deliveryLimits{domains: domains, waited: map[*limit]bool{}}
+}
+
+// wait until message can be sent by rate of l, once per delivery if several MX hosts are tried
+func (d *deliveryLimits) wait(ctx context.Context, l *limit) error {
+	if d.waited[l] {
+		return nil
+	}
+	d.waited[l] = true
+	return l.wait(ctx)
+}
+
+// wait until message can be sent by rate or ctx is done
+func (l *limit) wait(ctx context.Context) error {
+	if l == nil || l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+	if d := time.Until(at); d > 0 {
+		return sleepContext(ctx, d)
+	}
+	return nil
+}
+
+// acquire wait for free connection slot or ctx is done. If there is no free slot,
+// evict is called to close idle session holding slot of this limit
+func (l *limit) acquire(ctx context.Context, evict func(*limit) bool) error {
+	if l == nil || l.conns == nil {
+		return nil
+	}
+	atomic.AddInt32(&l.waiters, 1)
+	defer atomic.AddInt32(&l.waiters, -1)
+	for {
+		select {
+		case l.conns <- struct{}{}:
+			return nil
+		default:
+		}
+		if evict == nil || !evict(l) {
+			break
+		}
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waiting return true if connection waits for free slot
+func (l *limit) waiting() bool {
+	return l != nil && atomic.LoadInt32(&l.waiters) > 0
+}
+
+// release connection slot
+func (l *limit) release() {
+	if l == nil || l.conns == nil {
+		return
+	}
+	<-l.conns
+}
@@ -0,0 +1,207 @@
+package smtpSender
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RetryPolicy for resend emails with temporary (4xx) failures from Pipe
+type RetryPolicy struct {
+	// Delay before first retry, doubled after every next attempt. Default 1 minute
+	Delay time.Duration
+	// MaxDelay max delay between attempts. Default 1 hour
+	MaxDelay time.Duration
+	// Lifetime max time from first attempt, after that email is expired and last error returned. Default 24 hours
+	Lifetime time.Duration
+}
+
+const (
+	defaultRetryDelay    = time.Minute
+	defaultRetryMaxDelay = time.Hour
+	defaultRetryLifetime = 24 * time.Hour
+)
+
+// delay before next attempt
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempts && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// isTemporary check error is SMTPError with 4xx reply code
+func isTemporary(err error) bool {
+	var e *SMTPError
+	return errors.As(err, &e) && e.Temporary()
+}
+
+// retryQueue reschedule emails with temporary failed recipients
+type retryQueue struct {
+	policy  RetryPolicy
+	send    func(Email) error
+	mu      sync.Mutex
+	pending map[*retryEmail]*time.Timer
+	stopped bool
+}
+
+// retryEmail email state between attempts
+type retryEmail struct {
+	email      Email
+	resultFunc func(Result)
+	start      time.Time
+	attempts   int
+	recipients []string
+	// next recipients of scheduled attempt
+	next       []string
+	results    map[string]error
+	err        error
+	transcript []TranscriptLine
+	delivery   Result
+	done       bool
+}
+
+func newRetryQueue(policy RetryPolicy, send func(Email) error) *retryQueue {
+	if policy.Delay <= 0 {
+		policy.Delay = defaultRetryDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = defaultRetryMaxDelay
+	}
+	if policy.Lifetime <= 0 {
+		policy.Lifetime = defaultRetryLifetime
+	}
+	return &retryQueue{
+		policy:  policy,
+		send:    send,
+		pending: map[*retryEmail]*time.Timer{},
+	}
+}
+
+// wrap email result function, final result will be returned after all attempts
+func (q *retryQueue) wrap(e Email) Email {
+	if e.retry != nil {
+		return e
+	}
+	r := &retryEmail{
+		resultFunc: e.ResultFunc,
+		start:      time.Now(),
+		attempts:   e.attempts,
+		results:    map[string]error{},
+	}
+	if !e.start.IsZero() {
+		r.start = e.start
+	}
+	e.retry = r
+	e.ResultFunc = func(res Result) {
+		q.result(r, res)
+	}
+	r.email = e
+	return e
+}
+
+func (q *retryQueue) result(r *retryEmail, res Result) {
+	var retry []string
+	for _, rcpt := range res.Rcpt {
+		if _, ok := r.results[rcpt.Email]; !ok {
+			r.recipients = append(r.recipients, rcpt.Email)
+		}
+		r.results[rcpt.Email] = rcpt.Err
+		if rcpt.Err != nil && isTemporary(rcpt.Err) {
+			retry = append(retry, rcpt.Email)
+		}
+	}
+	r.err = res.Err
+	r.transcript = append(r.transcript, res.Transcript...)
+	if res.Reply != "" || r.delivery.Reply == "" {
+		r.delivery = res
+	}
+	r.attempts++
+
+	delay := q.policy.delay(r.attempts)
+	q.mu.Lock()
+	if len(retry) == 0 || q.stopped || r.email.context().Err() != nil || time.Since(r.start)+delay > q.policy.Lifetime {
+		q.mu.Unlock()
+		q.final(r)
+		return
+	}
+	r.next = retry
+	q.pending[r] = time.AfterFunc(delay, func() {
+		q.resend(r, retry)
+	})
+	q.mu.Unlock()
+}
+
+func (q *retryQueue) resend(r *retryEmail, rcpt []string) {
+	q.mu.Lock()
+	delete(q.pending, r)
+	q.mu.Unlock()
+
+	e := r.email
+	e.To = ""
+	e.Recipients = rcpt
+	if err := q.send(e); err != nil {
+		q.final(r)
+	}
+}
+
+// final call email result function once
+func (q *retryQueue) final(r *retryEmail) {
+	q.mu.Lock()
+	if r.done {
+		q.mu.Unlock()
+		return
+	}
+	r.done = true
+	q.mu.Unlock()
+
+	if r.resultFunc == nil {
+		return
+	}
+	// delivery fields of the last attempt accepted message
+	res := r.delivery
+	res.ID = r.email.ID
+	res.Duration = time.Since(r.start)
+	res.Transcript = r.transcript
+	res.Attempts = r.attempts
+	res.Rcpt = nil
+	for _, rcpt := range r.recipients {
+		res.Rcpt = append(res.Rcpt, RcptResult{Email: rcpt, Err: r.results[rcpt]})
+	}
+	if len(res.Rcpt) == 0 {
+		res.Err = r.err
+	} else {
+		res.Err = rcptErr(res.Rcpt)
+	}
+	r.resultFunc(res)
+}
+
+// stop return final result for all pending emails, except emails saved in spool,
+// they are returned with recipients of next attempt to stay in spool for send after restart
+func (q *retryQueue) stop() (spooled []Email) {
+	q.mu.Lock()
+	q.stopped = true
+	pending := make([]*retryEmail, 0, len(q.pending))
+	for r, timer := range q.pending {
+		timer.Stop()
+		pending = append(pending, r)
+	}
+	q.pending = map[*retryEmail]*time.Timer{}
+	q.mu.Unlock()
+
+	for _, r := range pending {
+		if r.email.spool != "" {
+			e := r.email
+			e.To = ""
+			e.Recipients = r.next
+			spooled = append(spooled, e)
+			continue
+		}
+		q.final(r)
+	}
+	return spooled
+}
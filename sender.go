@@ -1,8 +1,10 @@
 package smtpSender
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 )
 
 const Version = "0.0.8"
@@ -15,6 +17,30 @@ type Config struct {
 	Stream     int
 	MapIP      map[string]string
 	SMTPserver *SMTPserver
+	// SessionMessages max emails sent over one SMTP session to the same server,
+	// 0 or 1 open new session for every email
+	SessionMessages int
+	// SessionIdle close unused SMTP session after this timeout. Default 30 seconds
+	SessionIdle time.Duration
+	// Timeouts dial and SMTP commands timeouts, zero fields use defaults
+	Timeouts Timeouts
+	// LookupTries MX lookup tries. Default 3
+	LookupTries int
+	// DialTries connect to server tries. Default 5
+	DialTries int
+	// RateLimits limit messages rate and connections to recipient domains or MX hosts
+	// from this Config, emails wait when limit is reached
+	RateLimits []RateLimit
+	// TLS STARTTLS policy and options. Default opportunistic STARTTLS
+	TLS TLSOptions
+	// MTASTS enforce recipient domains MTA-STS policies if set
+	MTASTS *MTASTS
+	// DANE verify MX certificates by TLSA records if set
+	DANE TLSAResolver
+	// Resolver DNS resolver for MX, A/AAAA and PTR lookups. Default pipe DNSCache
+	Resolver Resolver
+	// TranscriptLogger receive SMTP conversation of every email if set
+	TranscriptLogger TranscriptLogger
 }
 
 // Pipe email pipe for send email
@@ -22,6 +48,14 @@ type Pipe struct {
 	wg     sync.WaitGroup
 	email  chan Email
 	config []Config
+	pools  []*sessionPool
+	limits []*rateLimiter
+	policy *RetryPolicy
+	retry  *retryQueue
+	spool  *Spool
+	dns    *DNSCache
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var ErrPipeStopped = errors.New("email streaming pipe stopped")
@@ -33,56 +67,227 @@ func NewPipe(conf ...Config) *Pipe {
 	return &pipe
 }
 
-// Start stream sender
-func (pipe *Pipe) Start() {
+// SetRetry enable resend emails with temporary (4xx) failures, ResultFunc
+// is called once when email is delivered, permanent failed or expired.
+// Use before Start.
+func (pipe *Pipe) SetRetry(policy RetryPolicy) *Pipe {
+	pipe.policy = &policy
+	return pipe
+}
+
+// SetSpool save emails to spool in Send and resend not delivered emails from spool in Start.
+// Use before Start.
+func (pipe *Pipe) SetSpool(spool *Spool) *Pipe {
+	pipe.spool = spool
+	return pipe
+}
+
+// SetDNSCache set DNS cache shared by all Config without own Resolver.
+// Default cache with net.DefaultResolver created in Start. Use before Start.
+func (pipe *Pipe) SetDNSCache(cache *DNSCache) *Pipe {
+	pipe.dns = cache
+	return pipe
+}
+
+// DNSCache return pipe DNS cache for statistics or flush, nil before Start if not set
+func (pipe *Pipe) DNSCache() *DNSCache {
+	return pipe.dns
+}
+
+// Start stream sender, error returned if spool can't be read
+func (pipe *Pipe) Start() error {
 	pipe.wg = sync.WaitGroup{}
 	pipe.email = make(chan Email, len(pipe.config))
+	pipe.pools = make([]*sessionPool, len(pipe.config))
+	pipe.limits = make([]*rateLimiter, len(pipe.config))
+	pipe.ctx, pipe.cancel = context.WithCancel(context.Background())
+	if pipe.dns == nil {
+		pipe.dns = NewDNSCache(nil, 0, 0)
+	}
+	if pipe.policy != nil {
+		pipe.retry = newRetryQueue(*pipe.policy, func(e Email) error {
+			return pipe.SendContext(e.context(), e)
+		})
+	}
+	for i := range pipe.config {
+		if pipe.config[i].SessionMessages > 1 {
+			pipe.pools[i] = newSessionPool(pipe.config[i].SessionMessages, pipe.config[i].SessionIdle)
+		}
+		pipe.limits[i] = newRateLimiter(pipe.config[i].RateLimits)
+	}
 
-	go func() {
-		for i := range pipe.config {
-
-			pipe.wg.Add(1)
-			go func(conf *Config) {
-				backet := make(chan struct{}, conf.Stream)
-				for email := range pipe.email {
-					backet <- struct{}{}
-					pipe.wg.Add(1)
-					go func(e Email) {
-						conn := new(Connect)
-						conn.SetHostName(conf.Hostname)
-						conn.SetSMTPport(conf.Port)
-						conn.SetIface(conf.Iface)
-						conn.mapIP = conf.MapIP
-						e.Send(conn, conf.SMTPserver)
-						<-backet
-						pipe.wg.Done()
-					}(email)
+	for i := range pipe.config {
+		pipe.wg.Add(1)
+		go func(conf *Config, pool *sessionPool, limiter *rateLimiter) {
+			backet := make(chan struct{}, conf.Stream)
+			for email := range pipe.email {
+				backet <- struct{}{}
+				pipe.wg.Add(1)
+				if pipe.retry != nil {
+					email = pipe.retry.wrap(email)
+				} else if email.spool != "" {
+					email = pipe.keepSpooled(email)
 				}
-				pipe.wg.Done()
-			}(&pipe.config[i])
+				go func(e Email) {
+					ctx, cancel := pipe.emailContext(e)
+					conn := new(Connect)
+					conn.SetHostName(conf.Hostname)
+					conn.SetSMTPport(conf.Port)
+					conn.SetIface(conf.Iface)
+					conn.SetTimeouts(conf.Timeouts)
+					conn.SetLookupTries(conf.LookupTries)
+					conn.SetDialTries(conf.DialTries)
+					conn.SetTLS(conf.TLS)
+					conn.SetMTASTS(conf.MTASTS)
+					conn.SetDANE(conf.DANE)
+					conn.SetTranscriptLogger(conf.TranscriptLogger)
+					if conf.Resolver != nil {
+						conn.SetResolver(conf.Resolver)
+					} else {
+						conn.SetResolver(pipe.dns)
+					}
+					conn.mapIP = conf.MapIP
+					conn.pool = pool
+					conn.limiter = limiter
+					e.SendContext(ctx, conn, conf.SMTPserver)
+					cancel()
+					<-backet
+					pipe.wg.Done()
+				}(email)
+			}
+			pipe.wg.Done()
+		}(&pipe.config[i], pipe.pools[i], pipe.limits[i])
+	}
 
+	if pipe.spool != nil {
+		emails, err := pipe.spool.recover()
+		if err != nil {
+			return err
 		}
-	}()
+		go func() {
+			for i := range emails {
+				if pipe.Send(emails[i]) != nil {
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// Send add email to stream, if pipe has spool email saved before
+func (pipe *Pipe) Send(email Email) error {
+	return pipe.SendContext(context.Background(), email)
 }
 
-// Send add email to stream
-func (pipe *Pipe) Send(email Email) (err error) {
+// SendContext add email to stream, ctx cancel waiting for place in stream and sending this email
+func (pipe *Pipe) SendContext(ctx context.Context, email Email) (err error) {
+	email.ctx = ctx
+	if pipe.spool != nil {
+		if email.spool == "" {
+			if err = pipe.spool.save(&email); err != nil {
+				return err
+			}
+			defer func(eml *Email, err *error) {
+				if *err != nil {
+					pipe.spool.remove(eml.spool)
+				}
+			}(&email, &err)
+		} else if err = pipe.spool.update(&email); err != nil {
+			return err
+		}
+	}
 	defer func(eml *Email, err *error) {
 		if e := recover(); e != nil {
 			*err = ErrPipeStopped
 			//eml.ResultFunc(Result{ID: eml.ID, Err: errors.New("421 email streaming pipe stopped")})
-		} else {
-			*err = nil
 		}
 	}(&email, &err)
-	pipe.email <- email
-	return
+	select {
+	case pipe.email <- email:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// emailContext return context for send email canceled on email context or pipe shutdown
+func (pipe *Pipe) emailContext(e Email) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(e.context())
+	go func() {
+		select {
+		case <-pipe.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// keepSpooled leave spooled email in spool without result if its recipients were canceled
+// by pipe shutdown, after restart email is resent to them
+func (pipe *Pipe) keepSpooled(e Email) Email {
+	resultFunc := e.ResultFunc
+	kept := e
+	e.ResultFunc = func(r Result) {
+		if pipe.ctx.Err() != nil {
+			var rcpt []string
+			for _, rr := range r.Rcpt {
+				if errors.Is(rr.Err, context.Canceled) {
+					rcpt = append(rcpt, rr.Email)
+				}
+			}
+			if len(rcpt) != 0 {
+				kept.To = ""
+				kept.Recipients = rcpt
+				_ = pipe.spool.update(&kept)
+				return
+			}
+		}
+		if resultFunc != nil {
+			resultFunc(r)
+		}
+	}
+	return e
 }
 
-// Stop stream sender
+// Stop stream sender and wait for sending emails
 func (pipe *Pipe) Stop() {
+	_ = pipe.Shutdown(context.Background())
+}
+
+// Shutdown stop stream sender and wait for sending emails. If ctx is done before,
+// sending emails are canceled with result error and ctx error is returned.
+// Canceled emails saved in spool stay there without result for send after restart.
+func (pipe *Pipe) Shutdown(ctx context.Context) error {
 	close(pipe.email)
-	pipe.wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		pipe.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		pipe.cancel()
+		<-done
+	}
+	pipe.cancel()
+
+	if pipe.retry != nil {
+		for _, e := range pipe.retry.stop() {
+			_ = pipe.spool.update(&e)
+		}
+	}
+	for i := range pipe.pools {
+		if pipe.pools[i] != nil {
+			pipe.pools[i].close()
+		}
+	}
+	return err
 }
 
 // NewEmailPipe return new chanel for stream send
@@ -2,12 +2,25 @@ package smtpSender_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/textproto"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -492,6 +505,23 @@ func runserver(t *testing.T, server *smtpd.Server, received chan receiveMail) (a
 	if err != nil {
 		t.Fatalf("Listen failed: %v", err)
 	}
+	return serve(server, ln, received)
+}
+
+// runimplicitserver run server with TLS handshake before greeting
+func runimplicitserver(t *testing.T, server *smtpd.Server, received chan receiveMail) (addr string, closer func()) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("Cert load failed: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.1.10:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return serve(server, ln, received)
+}
+
+func serve(server *smtpd.Server, ln net.Listener, received chan receiveMail) (addr string, closer func()) {
 	go func() {
 		server.Handler = func(peer smtpd.Peer, env smtpd.Envelope) error {
 			m := receiveMail{
@@ -531,3 +561,1814 @@ func runsslserver(t *testing.T, server *smtpd.Server, received chan receiveMail)
 
 	return runserver(t, server, received)
 }
+
+func TestEmail_SendRecipients(t *testing.T) {
+	received := make(chan receiveMail, 1)
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			RecipientChecker: func(peer smtpd.Peer, addr string) error {
+				if addr == "unknown@linklocal.supme.ru" {
+					return smtpd.Error{Code: 550, Message: "User unknown"}
+				}
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	var result smtpSender.Result
+	e := smtpSender.Email{
+		ID:         "recipients",
+		From:       "sender@localhost.localdomain",
+		To:         "recipient@linklocal.supme.ru",
+		Recipients: []string{"cc@linklocal.supme.ru", "unknown@linklocal.supme.ru", "bcc@linklocal.supme.ru"},
+		ResultFunc: func(r smtpSender.Result) {
+			result = r
+		},
+		WriteCloser: func(w io.WriteCloser) error {
+			_, err := io.WriteString(w, "Subject: test\r\n\r\nHello\r\n")
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		},
+	}
+
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	e.Send(conn, testServer(t, addr))
+
+	if result.Err != nil {
+		t.Fatalf("email not accepted: %v", result.Err)
+	}
+	want := map[string]bool{
+		"recipient@linklocal.supme.ru": true,
+		"cc@linklocal.supme.ru":        true,
+		"unknown@linklocal.supme.ru":   false,
+		"bcc@linklocal.supme.ru":       true,
+	}
+	if len(result.Rcpt) != len(want) {
+		t.Fatalf("recipient results count %d, want %d", len(result.Rcpt), len(want))
+	}
+	for _, r := range result.Rcpt {
+		if accepted, ok := want[r.Email]; !ok || accepted != (r.Err == nil) {
+			t.Errorf("recipient '%s' has unexpected result: %v", r.Email, r.Err)
+		}
+		var smtpErr *smtpSender.SMTPError
+		if r.Err != nil && (!errors.As(r.Err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Stage != smtpSender.StageRcpt) {
+			t.Errorf("recipient '%s' has not typed error: %#v", r.Email, r.Err)
+		}
+	}
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timeout receive email")
+	case r := <-received:
+		if len(r.Recipients) != 3 {
+			t.Errorf("server received %d recipients, want 3", len(r.Recipients))
+		}
+	}
+}
+
+// testServer return SMTPserver without authorization for test server addr
+func testServer(t *testing.T, addr string) *smtpSender.SMTPserver {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("split hostport: %v", err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &smtpSender.SMTPserver{Host: host, Port: p}
+}
+
+func TestPipe_SessionReuse(t *testing.T) {
+	const emails = 5
+	received := make(chan receiveMail, emails)
+	var connections int32
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			ConnectionChecker: func(peer smtpd.Peer) error {
+				atomic.AddInt32(&connections, 1)
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:        "localtest",
+		Stream:          1,
+		SMTPserver:      testServer(t, addr),
+		SessionMessages: 3,
+	})
+	pipe.Start()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < emails; i++ {
+		wg.Add(1)
+		e := testTextEmail("Id-"+strconv.Itoa(i), func(r smtpSender.Result) {
+			if r.Err != nil {
+				t.Errorf("email id '%s' result: %v", r.ID, r.Err)
+			}
+			wg.Done()
+		})
+		if err := pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	pipe.Stop()
+
+	if len(received) != emails {
+		t.Errorf("server received %d emails, want %d", len(received), emails)
+	}
+	if c := atomic.LoadInt32(&connections); c != 2 {
+		t.Errorf("server has %d connections, want 2", c)
+	}
+}
+
+func TestPipe_RateLimit(t *testing.T) {
+	const emails = 5
+	received := make(chan receiveMail, emails)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     emails,
+		SMTPserver: testServer(t, addr),
+		RateLimits: []smtpSender.RateLimit{
+			{Pattern: "example.com", Connections: 5},
+			{Pattern: "127.0.1.*", Messages: 1, Per: 100 * time.Millisecond, Connections: 1},
+		},
+	})
+	pipe.Start()
+	defer pipe.Stop()
+
+	results := make(chan smtpSender.Result, emails)
+	start := time.Now()
+	for i := 0; i < emails; i++ {
+		e := testTextEmail("Id-"+strconv.Itoa(i), func(r smtpSender.Result) {
+			results <- r
+		})
+		if err := pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < emails; i++ {
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Errorf("email id '%s' result: %v", r.ID, r.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout wait results")
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("%d emails sent in %s, want rate 1 per 100ms", emails, d)
+	}
+}
+
+func TestPipe_RateLimitRelay(t *testing.T) {
+	const emails = 4
+	received := make(chan receiveMail, emails)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+
+	// recipient domain rule apply to relay
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     emails,
+		SMTPserver: testServer(t, addr),
+		RateLimits: []smtpSender.RateLimit{
+			{Pattern: "linklocal.supme.ru", Messages: 1, Per: 100 * time.Millisecond},
+		},
+	})
+	pipe.Start()
+	defer pipe.Stop()
+
+	results := make(chan smtpSender.Result, emails)
+	start := time.Now()
+	for i := 0; i < emails; i++ {
+		e := testTextEmail("Id-"+strconv.Itoa(i), func(r smtpSender.Result) {
+			results <- r
+		})
+		if err := pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < emails; i++ {
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Errorf("email id '%s' result: %v", r.ID, r.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout wait results")
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("%d emails sent in %s, want rate 1 per 100ms", emails, d)
+	}
+}
+
+func TestPipe_RateLimitMX(t *testing.T) {
+	received := make(chan receiveMail, 2)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	// message wait for rate once, not for every tried MX
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname: "localtest",
+		Port:     p,
+		Stream:   1,
+		Resolver: testResolver{
+			mx: map[string][]*net.MX{
+				"linklocal.supme.ru": {{Host: "dangling.mx.test.", Pref: 10}, {Host: "mx1.mx.test.", Pref: 20}},
+			},
+			host: map[string][]string{
+				"mx1.mx.test.": {host},
+			},
+		},
+		RateLimits: []smtpSender.RateLimit{
+			{Pattern: "*", Messages: 1, Per: 300 * time.Millisecond},
+		},
+	})
+	pipe.Start()
+	defer pipe.Stop()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		results := make(chan smtpSender.Result, 1)
+		e := testTextEmail("Id-"+strconv.Itoa(i), func(r smtpSender.Result) {
+			results <- r
+		})
+		if err := pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Errorf("email id '%s' result: %v", r.ID, r.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout wait result")
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("2 emails sent in %s, want rate 1 per 300ms", d)
+	}
+}
+
+func TestPipe_RateLimitSessionIdle(t *testing.T) {
+	received := make(chan receiveMail, 2)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	// two MX hosts on one server have own pooled sessions but share connection limit
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:        "localtest",
+		Port:            p,
+		Stream:          1,
+		SessionMessages: 3,
+		SessionIdle:     4 * time.Second,
+		Resolver: testResolver{
+			mx: map[string][]*net.MX{
+				"a.test": {{Host: "mx1.test.", Pref: 10}},
+				"b.test": {{Host: "mx2.test.", Pref: 10}},
+			},
+			host: map[string][]string{
+				"mx1.test.": {host},
+				"mx2.test.": {host},
+			},
+		},
+		RateLimits: []smtpSender.RateLimit{
+			{Pattern: "mx?.test", Connections: 1},
+		},
+	})
+	pipe.Start()
+	defer pipe.Stop()
+
+	start := time.Now()
+	for _, domain := range []string{"a.test", "b.test"} {
+		results := make(chan smtpSender.Result, 1)
+		e := testTextEmail(domain, func(r smtpSender.Result) {
+			results <- r
+		})
+		e.To = "recipient@" + domain
+		if err := pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Errorf("email id '%s' result: %v", r.ID, r.Err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout wait result")
+		}
+	}
+	// idle session of first MX must be closed to free connection slot
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("emails sent in %s, idle session held connection slot", d)
+	}
+	if len(received) != 2 {
+		t.Errorf("server received %d emails, want 2", len(received))
+	}
+}
+
+// testTextEmail return simple text email to recipient@linklocal.supme.ru
+func testTextEmail(id string, resultFunc func(smtpSender.Result)) *smtpSender.Email {
+	return smtpSender.NewBuilder().
+		SetFrom("Sender", "sender@localhost.localdomain").
+		SetTo("Recipient", "recipient@linklocal.supme.ru").
+		SetSubject("Test message").
+		AddTextPart([]byte(testText)).
+		Email(id, resultFunc)
+}
+
+func TestPipe_Retry(t *testing.T) {
+	received := make(chan receiveMail, 4)
+	var greylisted, unknown int32
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			RecipientChecker: func(peer smtpd.Peer, addr string) error {
+				switch addr {
+				case "greylisted@linklocal.supme.ru":
+					if atomic.AddInt32(&greylisted, 1) < 3 {
+						return smtpd.Error{Code: 451, Message: "Greylisted, try again later"}
+					}
+				case "unknown@linklocal.supme.ru":
+					atomic.AddInt32(&unknown, 1)
+					return smtpd.Error{Code: 550, Message: "User unknown"}
+				case "full@linklocal.supme.ru":
+					return smtpd.Error{Code: 452, Message: "Mailbox full"}
+				}
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     1,
+		SMTPserver: testServer(t, addr),
+	}).SetRetry(smtpSender.RetryPolicy{
+		Delay:    10 * time.Millisecond,
+		MaxDelay: 20 * time.Millisecond,
+		Lifetime: 200 * time.Millisecond,
+	})
+	pipe.Start()
+
+	results := make(chan smtpSender.Result, 2)
+	e := testTextEmail("retry", func(r smtpSender.Result) {
+		results <- r
+	})
+	e.To = "greylisted@linklocal.supme.ru"
+	e.Recipients = []string{"unknown@linklocal.supme.ru", "recipient@linklocal.supme.ru", "full@linklocal.supme.ru"}
+	if err := pipe.Send(*e); err != nil {
+		t.Fatal(err)
+	}
+
+	var r smtpSender.Result
+	select {
+	case r = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout wait result")
+	}
+	pipe.Stop()
+	if len(results) != 0 {
+		t.Error("result function called more than once")
+	}
+
+	if r.Err != nil {
+		t.Errorf("email not delivered: %v", r.Err)
+	}
+	want := map[string]string{
+		"greylisted@linklocal.supme.ru": "",
+		"unknown@linklocal.supme.ru":    "550",
+		"recipient@linklocal.supme.ru":  "",
+		"full@linklocal.supme.ru":       "452",
+	}
+	if len(r.Rcpt) != len(want) {
+		t.Fatalf("recipient results count %d, want %d", len(r.Rcpt), len(want))
+	}
+	for _, rcpt := range r.Rcpt {
+		code := ""
+		if rcpt.Err != nil {
+			code = rcpt.Err.Error()[:3]
+		}
+		if code != want[rcpt.Email] {
+			t.Errorf("recipient '%s' result '%v', want code '%s'", rcpt.Email, rcpt.Err, want[rcpt.Email])
+		}
+	}
+	if c := atomic.LoadInt32(&unknown); c != 1 {
+		t.Errorf("permanent failed recipient tried %d times", c)
+	}
+	if r.Attempts < 3 {
+		t.Errorf("result Attempts %d, want at least 3", r.Attempts)
+	}
+	if r.Reply == "" {
+		t.Error("result has not reply of accepted attempt")
+	}
+	if len(received) == 0 {
+		t.Error("email not received")
+	}
+}
+
+func TestPipe_Spool(t *testing.T) {
+	received := make(chan receiveMail, 1)
+	var down int32 = 1
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			RecipientChecker: func(peer smtpd.Peer, addr string) error {
+				if atomic.LoadInt32(&down) == 1 {
+					return smtpd.Error{Code: 421, Message: "Service not available"}
+				}
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	dir := t.TempDir()
+	spool, err := smtpSender.NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     1,
+		SMTPserver: testServer(t, addr),
+	}
+
+	// first run, email stay in spool after stop
+	pipe := smtpSender.NewPipe(conf).
+		SetRetry(smtpSender.RetryPolicy{Delay: time.Hour}).
+		SetSpool(spool)
+	if err = pipe.Start(); err != nil {
+		t.Fatal(err)
+	}
+	e := testTextEmail("spooled", func(r smtpSender.Result) {
+		t.Errorf("result for email in spool: %+v", r)
+	})
+	if err = pipe.Send(*e); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	pipe.Stop()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("spool has %d files, want 2", len(files))
+	}
+	// attempts are kept for retry after restart
+	envelopes, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var envelope struct{ Attempts int }
+	if data, err := ioutil.ReadFile(envelopes[0]); err != nil || json.Unmarshal(data, &envelope) != nil || envelope.Attempts != 1 {
+		t.Errorf("spool envelope has %d attempts, want 1", envelope.Attempts)
+	}
+
+	// second run, recovered email delivered and removed from spool
+	atomic.StoreInt32(&down, 0)
+	results := make(chan smtpSender.Result, 1)
+	spool, err = smtpSender.NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.ResultFunc = func(r smtpSender.Result) {
+		results <- r
+	}
+	pipe = smtpSender.NewPipe(conf).SetSpool(spool)
+	if err = pipe.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-results:
+		if r.ID != "spooled" || r.Err != nil {
+			t.Errorf("recovered email result: %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout wait recovered email result")
+	}
+	pipe.Stop()
+
+	select {
+	case r := <-received:
+		if _, err := enmime.ReadEnvelope(bytes.NewReader(r.Data)); err != nil {
+			t.Errorf("parse recovered email: %v", err)
+		}
+	default:
+		t.Error("recovered email not received")
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("spool has %d files after delivery", len(files))
+	}
+}
+
+func TestPipe_SpoolShutdown(t *testing.T) {
+	addr, closer := runstallserver(t)
+	defer closer()
+
+	dir := t.TempDir()
+	spool, err := smtpSender.NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     1,
+		SMTPserver: testServer(t, addr),
+	}).SetSpool(spool)
+	if err = pipe.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the first email is sending, the second is queued
+	for _, id := range []string{"sending", "queued"} {
+		e := testTextEmail(id, func(r smtpSender.Result) {
+			t.Errorf("result for email in spool: %+v", r)
+		})
+		if err = pipe.Send(*e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = pipe.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown return '%v'", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 4 {
+		t.Errorf("spool has %d files after shutdown, want 4", len(files))
+	}
+}
+
+// runstallserver accept connections and never answer
+func runstallserver(t *testing.T) (addr string, closer func()) {
+	ln, err := net.Listen("tcp", "127.0.1.10:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	var conns []net.Conn
+	mu := sync.Mutex{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String(), func() {
+		ln.Close()
+		mu.Lock()
+		for i := range conns {
+			conns[i].Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// scriptServer minimal SMTP server with own EHLO extensions, records client commands and messages
+type scriptServer struct {
+	extensions []string
+	// reply return reply line for command instead of default if not empty
+	reply    func(cmd string) string
+	mu       sync.Mutex
+	commands []string
+	messages [][]byte
+	// pipelined count of commands received with next command in the same read
+	pipelined int
+	// stallData do not reply to message data and following commands
+	stallData bool
+}
+
+func runscriptserver(t *testing.T, s *scriptServer) (addr string, closer func()) {
+	ln, err := net.Listen("tcp", "127.0.1.10:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String(), func() {
+		ln.Close()
+	}
+}
+
+func (s *scriptServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	_ = text.PrintfLine("220 localhost ESMTP")
+	var chunks []byte
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		if text.R.Buffered() != 0 {
+			s.pipelined++
+		}
+		s.mu.Unlock()
+		fields := strings.Fields(line)
+		cmd := strings.ToUpper(fields[0])
+		if cmd == "BDAT" && len(fields) > 1 {
+			size, _ := strconv.Atoi(fields[1])
+			chunk := make([]byte, size)
+			if _, err = io.ReadFull(text.R, chunk); err != nil {
+				return
+			}
+			chunks = append(chunks, chunk...)
+		}
+		if s.reply != nil {
+			if reply := s.reply(line); reply != "" {
+				_ = text.PrintfLine("%s", reply)
+				continue
+			}
+		}
+		switch cmd {
+		case "EHLO":
+			extensions := append([]string{"localhost"}, s.extensions...)
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				_ = text.PrintfLine("250%s%s", sep, ext)
+			}
+		case "RSET":
+			chunks = nil
+			_ = text.PrintfLine("250 2.0.0 Ok")
+		case "HELO", "MAIL", "RCPT", "NOOP":
+			_ = text.PrintfLine("250 2.0.0 Ok")
+		case "DATA":
+			_ = text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			// ReadDotBytes return LF lines
+			s.messages = append(s.messages, bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+			s.mu.Unlock()
+			if s.stallData {
+				_, _ = io.Copy(io.Discard, text.R)
+				return
+			}
+			_ = text.PrintfLine("250 2.0.0 Ok: queued as 1")
+		case "BDAT":
+			if len(fields) < 3 || strings.ToUpper(fields[2]) != "LAST" {
+				_ = text.PrintfLine("250 2.0.0 %d octets received", len(chunks))
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, chunks)
+			s.mu.Unlock()
+			chunks = nil
+			_ = text.PrintfLine("250 2.0.0 Ok: queued as 1")
+		case "QUIT":
+			_ = text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			_ = text.PrintfLine("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+// received return recorded commands and messages
+func (s *scriptServer) received() (commands []string, messages [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), append([][]byte(nil), s.messages...)
+}
+
+func TestEmail_SendSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		name       string
+		from, to   string
+		extensions []string
+		code       int
+		want       []string
+	}{
+		{
+			name:       "utf8",
+			from:       "Отправитель <отправитель@localhost.localdomain>",
+			to:         "Получатель <получатель@пример.рф>",
+			extensions: []string{"8BITMIME", "SMTPUTF8"},
+			want:       []string{"MAIL FROM:<отправитель@localhost.localdomain> BODY=8BITMIME SMTPUTF8", "RCPT TO:<получатель@xn--e1afmkfd.xn--p1ai>"},
+		},
+		{
+			name:       "ascii",
+			from:       "sender@localhost.localdomain",
+			to:         "recipient@linklocal.supme.ru",
+			extensions: []string{"SMTPUTF8"},
+			want:       []string{"MAIL FROM:<sender@localhost.localdomain>", "RCPT TO:<recipient@linklocal.supme.ru>"},
+		},
+		{
+			name: "idn",
+			from: "sender@localhost.localdomain",
+			to:   "user@bücher.de",
+			want: []string{"MAIL FROM:<sender@localhost.localdomain>", "RCPT TO:<user@xn--bcher-kva.de>"},
+		},
+		{
+			name: "not supported",
+			from: "sender@localhost.localdomain",
+			to:   "получатель@пример.рф",
+			code: 553,
+		},
+	}
+	for _, test := range tests {
+		server := &scriptServer{extensions: test.extensions}
+		addr, closer := runscriptserver(t, server)
+
+		var result smtpSender.Result
+		e := testTextEmail(test.name, func(r smtpSender.Result) {
+			result = r
+		})
+		e.From = test.from
+		e.To = test.to
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, testServer(t, addr))
+		closer()
+
+		commands, messages := server.received()
+		if test.code != 0 {
+			var smtpErr *smtpSender.SMTPError
+			if !errors.As(result.Err, &smtpErr) || smtpErr.Code != test.code || smtpErr.EnhancedCode != "5.6.7" {
+				t.Errorf("%s: result '%v', want %d error", test.name, result.Err, test.code)
+			}
+			if len(messages) != 0 {
+				t.Errorf("%s: server received message", test.name)
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Errorf("%s: result: %v", test.name, result.Err)
+			continue
+		}
+		if len(commands) < 3 || commands[1] != test.want[0] || commands[2] != test.want[1] {
+			t.Errorf("%s: commands %q, want %q", test.name, commands, test.want)
+		}
+	}
+}
+
+func TestEmail_SendDSN(t *testing.T) {
+	tests := []struct {
+		extensions []string
+		want       []string
+	}{
+		{
+			extensions: []string{"DSN"},
+			want: []string{
+				"MAIL FROM:<sender@localhost.localdomain> RET=HDRS ENVID=batch+2B1",
+				"RCPT TO:<Recipient@linklocal.supme.ru> NOTIFY=FAILURE,DELAY ORCPT=rfc822;Recipient@linklocal.supme.ru",
+			},
+		},
+		{
+			want: []string{
+				"MAIL FROM:<sender@localhost.localdomain>",
+				"RCPT TO:<Recipient@linklocal.supme.ru>",
+			},
+		},
+	}
+	for _, test := range tests {
+		server := &scriptServer{extensions: test.extensions}
+		addr, closer := runscriptserver(t, server)
+
+		var result smtpSender.Result
+		e := smtpSender.NewBuilder().
+			SetFrom("Sender", "sender@localhost.localdomain").
+			// local part case is kept in RCPT TO and ORCPT
+			SetTo("Recipient", "Recipient@Linklocal.Supme.ru").
+			SetSubject("Test message").
+			SetDSNReturn(smtpSender.DSNReturnHeaders).
+			SetDSNEnvelopeID("batch+1").
+			SetDSNNotify(smtpSender.DSNNotifyFailure, smtpSender.DSNNotifyDelay).
+			AddTextPart([]byte(testText)).
+			Email("dsn", func(r smtpSender.Result) {
+				result = r
+			})
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, testServer(t, addr))
+		closer()
+
+		if result.Err != nil {
+			t.Errorf("extensions %q result: %v", test.extensions, result.Err)
+			continue
+		}
+		commands, _ := server.received()
+		if len(commands) < 3 || commands[1] != test.want[0] || commands[2] != test.want[1] {
+			t.Errorf("extensions %q commands %q, want %q", test.extensions, commands, test.want)
+		}
+	}
+}
+
+func TestEmail_SendSize(t *testing.T) {
+	server := &scriptServer{extensions: []string{"SIZE 1000"}}
+	addr, closer := runscriptserver(t, server)
+	defer closer()
+
+	tests := []struct {
+		size int
+		code int
+		want string
+	}{
+		{size: 500, want: "MAIL FROM:<sender@localhost.localdomain> SIZE=500"},
+		{size: 0, want: "MAIL FROM:<sender@localhost.localdomain>"},
+		{size: 2000, code: 552},
+	}
+	for _, test := range tests {
+		var result smtpSender.Result
+		e := testTextEmail("size", func(r smtpSender.Result) {
+			result = r
+		})
+		e.Size = test.size
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, testServer(t, addr))
+
+		commands, _ := server.received()
+		var mail string
+		for i := range commands {
+			if strings.HasPrefix(commands[i], "MAIL") {
+				mail = commands[i]
+			}
+		}
+		if test.code != 0 {
+			var smtpErr *smtpSender.SMTPError
+			if !errors.As(result.Err, &smtpErr) || smtpErr.Code != test.code || smtpErr.EnhancedCode != "5.3.4" {
+				t.Errorf("size %d result '%v', want %d error", test.size, result.Err, test.code)
+			}
+			if n := len(commands); commands[n-2] != "EHLO localtest" || commands[n-1] != "QUIT" {
+				t.Errorf("size %d commands %q, want no transaction", test.size, commands)
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Errorf("size %d result: %v", test.size, result.Err)
+		}
+		if mail != test.want {
+			t.Errorf("size %d command '%s', want '%s'", test.size, mail, test.want)
+		}
+	}
+}
+
+func TestEmail_SendChunking(t *testing.T) {
+	png, err := ioutil.ReadFile("./testdata/knwoman.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		extensions []string
+		body       string
+		mail       string
+		chunking   bool
+		want       []string
+	}{
+		{
+			name:       "binary",
+			extensions: []string{"8BITMIME", "CHUNKING", "BINARYMIME"},
+			body:       smtpSender.BodyBinaryMIME,
+			mail:       "MAIL FROM:<sender@localhost.localdomain> BODY=BINARYMIME",
+			chunking:   true,
+			want:       []string{"Content-Transfer-Encoding: 8bit\r\n", "Content-Transfer-Encoding: binary\r\n", string(png)},
+		},
+		{
+			name:       "8bit",
+			extensions: []string{"8BITMIME"},
+			body:       smtpSender.BodyBinaryMIME,
+			mail:       "MAIL FROM:<sender@localhost.localdomain> BODY=8BITMIME",
+			want:       []string{"Content-Transfer-Encoding: 8bit\r\n", "Content-Transfer-Encoding: base64\r\n"},
+		},
+		{
+			name:       "chunking",
+			extensions: []string{"CHUNKING"},
+			mail:       "MAIL FROM:<sender@localhost.localdomain>",
+			chunking:   true,
+			want:       []string{"Content-Transfer-Encoding: quoted-printable\r\n", "Content-Transfer-Encoding: base64\r\n"},
+		},
+	}
+	for _, test := range tests {
+		server := &scriptServer{extensions: test.extensions}
+		addr, closer := runscriptserver(t, server)
+
+		var result smtpSender.Result
+		bldr := smtpSender.NewBuilder().
+			SetFrom("Sender", "sender@localhost.localdomain").
+			SetTo("Recipient", "recipient@linklocal.supme.ru").
+			SetSubject("Test message").
+			SetBodyType(test.body).
+			AddTextPart([]byte("Привет, буфет\r\nЗдорова, колбаса!\r\n"))
+		if err := bldr.AddAttachment("./testdata/knwoman.png"); err != nil {
+			t.Fatal(err)
+		}
+		e := bldr.Email(test.name, func(r smtpSender.Result) {
+			result = r
+		})
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, testServer(t, addr))
+		closer()
+
+		if result.Err != nil {
+			t.Errorf("%s: result: %v", test.name, result.Err)
+			continue
+		}
+		commands, messages := server.received()
+		if len(commands) < 2 || commands[1] != test.mail {
+			t.Errorf("%s: commands %q, want '%s'", test.name, commands, test.mail)
+		}
+		var bdat, data bool
+		for _, cmd := range commands {
+			bdat = bdat || strings.HasPrefix(cmd, "BDAT")
+			data = data || cmd == "DATA"
+		}
+		if bdat != test.chunking || data == test.chunking {
+			t.Errorf("%s: commands %q, want chunking %v", test.name, commands, test.chunking)
+		}
+		if len(messages) != 1 {
+			t.Errorf("%s: server received %d messages", test.name, len(messages))
+			continue
+		}
+		for _, want := range test.want {
+			if !bytes.Contains(messages[0], []byte(want)) {
+				t.Errorf("%s: message has not '%.40q'", test.name, want)
+			}
+		}
+		if result.Reply != "2.0.0 Ok: queued as 1" {
+			t.Errorf("%s: result reply '%s'", test.name, result.Reply)
+		}
+	}
+}
+
+func TestEmail_SendChunkingRcpt(t *testing.T) {
+	server := &scriptServer{
+		extensions: []string{"CHUNKING"},
+		reply: func(cmd string) string {
+			if cmd == "RCPT TO:<bad@linklocal.supme.ru>" {
+				return "550 5.1.1 no such user"
+			}
+			return ""
+		},
+	}
+	addr, closer := runscriptserver(t, server)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("bdat rcpt", func(r smtpSender.Result) {
+		result = r
+	})
+	e.Recipients = []string{"bad@linklocal.supme.ru"}
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	e.Send(conn, testServer(t, addr))
+
+	if result.Err != nil {
+		t.Errorf("result: %v", result.Err)
+	}
+	for _, rcpt := range result.Rcpt {
+		if (rcpt.Err == nil) != (rcpt.Email == "recipient@linklocal.supme.ru") {
+			t.Errorf("recipient '%s' result '%v'", rcpt.Email, rcpt.Err)
+		}
+	}
+	if _, messages := server.received(); len(messages) != 1 {
+		t.Errorf("server received %d messages, want 1", len(messages))
+	}
+}
+
+func TestEmail_SendChunkingError(t *testing.T) {
+	server := &scriptServer{
+		extensions: []string{"CHUNKING"},
+		reply: func(cmd string) string {
+			if strings.HasPrefix(cmd, "BDAT") {
+				return "554 5.6.0 Message rejected"
+			}
+			return ""
+		},
+	}
+	addr, closer := runscriptserver(t, server)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("bdat", func(r smtpSender.Result) {
+		result = r
+	})
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	e.Send(conn, testServer(t, addr))
+
+	var smtpErr *smtpSender.SMTPError
+	if !errors.As(result.Err, &smtpErr) || smtpErr.Code != 554 || smtpErr.Stage != smtpSender.StageData {
+		t.Errorf("result '%v', want 554 data error", result.Err)
+	}
+}
+
+func TestEmail_SendPipelining(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply func(cmd string) string
+		want  map[string]int
+	}{
+		{
+			name: "rcpt",
+			reply: func(cmd string) string {
+				if cmd == "RCPT TO:<unknown@linklocal.supme.ru>" {
+					return "550 5.1.1 User unknown"
+				}
+				return ""
+			},
+			want: map[string]int{"recipient@linklocal.supme.ru": 0, "unknown@linklocal.supme.ru": 550, "other@linklocal.supme.ru": 0},
+		},
+		{
+			name: "mail",
+			reply: func(cmd string) string {
+				if strings.HasPrefix(cmd, "MAIL") {
+					return "550 5.7.1 Sender rejected"
+				}
+				return ""
+			},
+			want: map[string]int{"recipient@linklocal.supme.ru": 550, "unknown@linklocal.supme.ru": 550, "other@linklocal.supme.ru": 550},
+		},
+	}
+	for _, test := range tests {
+		server := &scriptServer{extensions: []string{"PIPELINING"}, reply: test.reply}
+		addr, closer := runscriptserver(t, server)
+
+		var result smtpSender.Result
+		e := testTextEmail(test.name, func(r smtpSender.Result) {
+			result = r
+		})
+		e.Recipients = []string{"unknown@linklocal.supme.ru", "other@linklocal.supme.ru"}
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, testServer(t, addr))
+		closer()
+
+		if len(result.Rcpt) != len(test.want) {
+			t.Fatalf("%s: recipient results %v", test.name, result.Rcpt)
+		}
+		for _, rcpt := range result.Rcpt {
+			var code int
+			var smtpErr *smtpSender.SMTPError
+			if errors.As(rcpt.Err, &smtpErr) {
+				code = smtpErr.Code
+			}
+			if code != test.want[rcpt.Email] {
+				t.Errorf("%s: recipient '%s' result '%v', want code %d", test.name, rcpt.Email, rcpt.Err, test.want[rcpt.Email])
+			}
+		}
+
+		commands, messages := server.received()
+		want := []string{
+			"EHLO localtest",
+			"MAIL FROM:<sender@localhost.localdomain>",
+			"RCPT TO:<recipient@linklocal.supme.ru>",
+			"RCPT TO:<unknown@linklocal.supme.ru>",
+			"RCPT TO:<other@linklocal.supme.ru>",
+			"DATA",
+		}
+		if len(commands) < len(want) || !reflect.DeepEqual(commands[:len(want)], want) || commands[len(commands)-1] != "QUIT" {
+			t.Errorf("%s: commands %q", test.name, commands)
+		}
+		server.mu.Lock()
+		pipelined := server.pipelined
+		server.mu.Unlock()
+		if pipelined < 4 {
+			t.Errorf("%s: %d commands pipelined, want 4", test.name, pipelined)
+		}
+		if test.want["recipient@linklocal.supme.ru"] != 0 && len(messages) == 1 && len(messages[0]) != 0 {
+			t.Errorf("%s: message sent after rejected MAIL FROM", test.name)
+		}
+	}
+}
+
+func TestEmail_SendContext(t *testing.T) {
+	addr, closer := runstallserver(t)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("context", func(r smtpSender.Result) {
+		result = r
+	})
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	e.SendContext(ctx, conn, testServer(t, addr))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("send canceled after %s", d)
+	}
+	if !errors.Is(result.Err, context.DeadlineExceeded) {
+		t.Errorf("result error '%v' is not context deadline", result.Err)
+	}
+}
+
+func TestEmail_SendTimeouts(t *testing.T) {
+	addr, closer := runstallserver(t)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("timeouts", func(r smtpSender.Result) {
+		result = r
+	})
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	conn.SetTimeouts(smtpSender.Timeouts{Greeting: 100 * time.Millisecond})
+
+	start := time.Now()
+	e.Send(conn, testServer(t, addr))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("greeting timeout after %s", d)
+	}
+	var smtpErr *smtpSender.SMTPError
+	if !errors.As(result.Err, &smtpErr) {
+		t.Fatalf("result error '%v' is not SMTPError", result.Err)
+	}
+	if smtpErr.Stage != smtpSender.StageGreeting || !smtpErr.Temporary() {
+		t.Errorf("want temporary greeting error, got '%v'", smtpErr)
+	}
+}
+
+func TestEmail_SendTimeoutsData(t *testing.T) {
+	server := &scriptServer{stallData: true}
+	addr, closer := runscriptserver(t, server)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("data timeout", func(r smtpSender.Result) {
+		result = r
+	})
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	conn.SetTimeouts(smtpSender.Timeouts{DataTermination: 200 * time.Millisecond, Command: 3 * time.Second})
+
+	start := time.Now()
+	e.Send(conn, testServer(t, addr))
+	// stalled session must be closed without waiting QUIT reply
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("send returned after %s", d)
+	}
+	var smtpErr *smtpSender.SMTPError
+	if !errors.As(result.Err, &smtpErr) {
+		t.Fatalf("result error '%v' is not SMTPError", result.Err)
+	}
+	if smtpErr.Stage != smtpSender.StageData || !smtpErr.Temporary() {
+		t.Errorf("want temporary data error, got '%v'", smtpErr)
+	}
+}
+
+func TestEmail_SendTLSPolicy(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("Cert load failed: %v", err)
+	}
+	received := make(chan receiveMail, 5)
+	addr, closer := runserver(
+		t,
+		&smtpd.Server{
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MaxVersion:   tls.VersionTLS12,
+			},
+		},
+		received)
+	defer closer()
+	plainAddr, plainCloser := runserver(t, &smtpd.Server{}, received)
+	defer plainCloser()
+
+	tests := []struct {
+		addr      string
+		options   smtpSender.TLSOptions
+		delivered bool
+	}{
+		{addr, smtpSender.TLSOptions{}, true},
+		{addr, smtpSender.TLSOptions{Policy: smtpSender.TLSRequire}, true},
+		{addr, smtpSender.TLSOptions{Policy: smtpSender.TLSRequireVerify}, false},
+		{addr, smtpSender.TLSOptions{MinVersion: tls.VersionTLS13}, true},
+		{addr, smtpSender.TLSOptions{Policy: smtpSender.TLSRequire, MinVersion: tls.VersionTLS13}, false},
+		{plainAddr, smtpSender.TLSOptions{Policy: smtpSender.TLSRequire}, false},
+		{plainAddr, smtpSender.TLSOptions{Policy: smtpSender.TLSNone}, true},
+	}
+	for i, test := range tests {
+		var result smtpSender.Result
+		e := testTextEmail("tls", func(r smtpSender.Result) {
+			result = r
+		})
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		conn.SetTLS(test.options)
+		e.Send(conn, testServer(t, test.addr))
+
+		if test.delivered {
+			if result.Err != nil {
+				t.Errorf("test %d result: %v", i, result.Err)
+			}
+			continue
+		}
+		var smtpErr *smtpSender.SMTPError
+		if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageStartTLS || !smtpErr.Temporary() {
+			t.Errorf("test %d result '%v', want temporary starttls error", i, result.Err)
+		}
+	}
+	if len(received) != 4 {
+		t.Errorf("server received %d emails, want 4", len(received))
+	}
+}
+
+func TestEmail_SendImplicitTLS(t *testing.T) {
+	received := make(chan receiveMail, 1)
+	addr, closer := runimplicitserver(t, &smtpd.Server{}, received)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("implicit", func(r smtpSender.Result) {
+		result = r
+	})
+	server := testServer(t, addr)
+	server.TLS = &smtpSender.TLSOptions{Implicit: true}
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	e.Send(conn, server)
+	if result.Err != nil {
+		t.Fatalf("result: %v", result.Err)
+	}
+	if len(received) != 1 {
+		t.Errorf("server received %d emails, want 1", len(received))
+	}
+
+	conn.SetTimeouts(smtpSender.Timeouts{Greeting: 100 * time.Millisecond})
+	e.Send(conn, testServer(t, addr))
+	var smtpErr *smtpSender.SMTPError
+	if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageGreeting {
+		t.Errorf("plain connect to implicit TLS server result '%v', want greeting error", result.Err)
+	}
+}
+
+func TestEmail_SendAuth(t *testing.T) {
+	received := make(chan receiveMail, 2)
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			Authenticator: func(peer smtpd.Peer, username, password string) error {
+				if username != "user" || password != "secret" {
+					return smtpd.Error{Code: 535, Message: "5.7.8 Authentication credentials invalid"}
+				}
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	tests := []struct {
+		method, password string
+		code             int
+	}{
+		{"", "secret", 0},
+		{smtpSender.AuthLogin, "secret", 0},
+		{smtpSender.AuthPlain, "wrong", 535},
+	}
+	for _, test := range tests {
+		var result smtpSender.Result
+		e := testTextEmail("auth", func(r smtpSender.Result) {
+			result = r
+		})
+		server := testServer(t, addr)
+		server.Username = "user"
+		server.Password = test.password
+		server.AuthMethod = test.method
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, server)
+
+		if test.code == 0 {
+			if result.Err != nil {
+				t.Errorf("auth '%s' result: %v", test.method, result.Err)
+			}
+			continue
+		}
+		var smtpErr *smtpSender.SMTPError
+		if !errors.As(result.Err, &smtpErr) || smtpErr.Code != test.code || smtpErr.Stage != smtpSender.StageAuth {
+			t.Errorf("auth '%s' result '%v', want %d auth error", test.method, result.Err, test.code)
+		}
+	}
+	if len(received) != 2 {
+		t.Errorf("server received %d emails, want 2", len(received))
+	}
+}
+
+type testTranscriptLogger struct {
+	mu    sync.Mutex
+	lines []smtpSender.TranscriptLine
+}
+
+func (l *testTranscriptLogger) Transcript(id string, line smtpSender.TranscriptLine) {
+	l.mu.Lock()
+	l.lines = append(l.lines, line)
+	l.mu.Unlock()
+}
+
+func TestEmail_SendTranscript(t *testing.T) {
+	received := make(chan receiveMail, 1)
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			Authenticator: func(peer smtpd.Peer, username, password string) error {
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("transcript", func(r smtpSender.Result) {
+		result = r
+	})
+	e.Transcript = true
+	server := testServer(t, addr)
+	server.Username = "user"
+	server.Password = "secret"
+	logger := &testTranscriptLogger{}
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	conn.SetTranscriptLogger(logger)
+	e.Send(conn, server)
+	if result.Err != nil {
+		t.Fatalf("result: %v", result.Err)
+	}
+
+	var transcript []string
+	for _, line := range result.Transcript {
+		transcript = append(transcript, line.String())
+	}
+	text := strings.Join(transcript, "\n")
+	for _, want := range []string{
+		"S: 220 ",
+		"C: EHLO localtest",
+		"C: STARTTLS",
+		"C: AUTH PLAIN <redacted>",
+		"S: 235 ",
+		"C: MAIL FROM:<sender@localhost.localdomain>",
+		"C: RCPT TO:<recipient@linklocal.supme.ru>",
+		"C: DATA",
+		"C: <message body ",
+		"C: QUIT",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("transcript has not '%s':\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "secret") || strings.Contains(text, base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))) {
+		t.Errorf("transcript has credentials:\n%s", text)
+	}
+	if strings.Contains(text, "Subject:") {
+		t.Errorf("transcript has message body:\n%s", text)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) != len(result.Transcript) {
+		t.Errorf("logger received %d lines, want %d", len(logger.lines), len(result.Transcript))
+	}
+}
+
+func TestEmail_SendResult(t *testing.T) {
+	received := make(chan receiveMail, 1)
+	addr, closer := runsslserver(
+		t,
+		&smtpd.Server{
+			Authenticator: func(peer smtpd.Peer, username, password string) error {
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	var result smtpSender.Result
+	e := testTextEmail("result", func(r smtpSender.Result) {
+		result = r
+	})
+	var message bytes.Buffer
+	if err := e.WriteCloser(nopCloser{&message}); err != nil {
+		t.Fatal(err)
+	}
+	e.WriteCloser = func(w io.WriteCloser) error {
+		if _, err := w.Write(message.Bytes()); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	server := testServer(t, addr)
+	server.Username = "user"
+	server.Password = "secret"
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	e.Send(conn, server)
+	if result.Err != nil {
+		t.Fatalf("result: %v", result.Err)
+	}
+
+	<-received
+	tests := []struct {
+		name, value, want string
+	}{
+		{"Host", result.Host, "127.0.1.10"},
+		{"RemoteIP", result.RemoteIP, "127.0.1.10"},
+		{"HeloName", result.HeloName, "localtest"},
+		{"Auth", result.Auth, smtpSender.AuthPlain},
+		{"Reply", result.Reply, "Thank you."},
+		{"Proxy", result.Proxy, ""},
+	}
+	for _, test := range tests {
+		if test.value != test.want {
+			t.Errorf("result %s '%s', want '%s'", test.name, test.value, test.want)
+		}
+	}
+	if result.LocalIP == "" {
+		t.Error("result LocalIP is empty")
+	}
+	if !strings.HasPrefix(result.TLSVersion, "TLS 1.") || result.TLSCipher == "" {
+		t.Errorf("result TLS '%s' '%s'", result.TLSVersion, result.TLSCipher)
+	}
+	if result.Size != message.Len() {
+		t.Errorf("result Size %d, want %d", result.Size, message.Len())
+	}
+	if result.Attempts != 1 {
+		t.Errorf("result Attempts %d, want 1", result.Attempts)
+	}
+}
+
+func TestEmail_SendClientCertificate(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("Cert load failed: %v", err)
+	}
+	var peerCerts int32
+	received := make(chan receiveMail, 1)
+	addr, closer := runserver(
+		t,
+		&smtpd.Server{
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			},
+			SenderChecker: func(peer smtpd.Peer, addr string) error {
+				if peer.TLS != nil {
+					atomic.StoreInt32(&peerCerts, int32(len(peer.TLS.PeerCertificates)))
+				}
+				return nil
+			},
+		},
+		received)
+	defer closer()
+
+	for _, certs := range [][]tls.Certificate{nil, {cert}} {
+		var result smtpSender.Result
+		e := testTextEmail("certificate", func(r smtpSender.Result) {
+			result = r
+		})
+		server := testServer(t, addr)
+		server.TLS = &smtpSender.TLSOptions{Policy: smtpSender.TLSRequire, Certificates: certs}
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		e.Send(conn, server)
+
+		if certs == nil {
+			var smtpErr *smtpSender.SMTPError
+			if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageStartTLS {
+				t.Errorf("without certificate result '%v', want starttls error", result.Err)
+			}
+		} else if result.Err != nil {
+			t.Errorf("with certificate result: %v", result.Err)
+		}
+	}
+	if n := atomic.LoadInt32(&peerCerts); len(received) != 1 || n != 1 {
+		t.Errorf("server received %d emails with %d client certificates, want 1 with 1", len(received), n)
+	}
+}
+
+// testResolver resolve MX and hosts from maps, not existing names return not found error
+type testResolver struct {
+	mx   map[string][]*net.MX
+	host map[string][]string
+	txt  map[string][]string
+}
+
+func (r testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.host[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return []string{"localtest."}, nil
+}
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// testTLSAResolver return TLSA records from map
+type testTLSAResolver struct {
+	records map[string][]smtpSender.TLSA
+	secure  bool
+}
+
+func (r testTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]smtpSender.TLSA, bool, error) {
+	return r.records[name], r.secure, nil
+}
+
+func TestEmail_SendDANE(t *testing.T) {
+	received := make(chan receiveMail, 4)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	block, _ := pem.Decode(localhostCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	name := "_" + port + "._tcp.mx1.mx.test"
+
+	resolver := testResolver{
+		mx:   map[string][]*net.MX{"mx.test": {{Host: "mx1.mx.test.", Pref: 10}}},
+		host: map[string][]string{"mx1.mx.test.": {host}},
+	}
+	tests := []struct {
+		tlsa      testTLSAResolver
+		delivered bool
+	}{
+		{testTLSAResolver{map[string][]smtpSender.TLSA{name: {{Usage: 3, Selector: 1, MatchingType: 1, Data: sum[:]}}}, true}, true},
+		{testTLSAResolver{map[string][]smtpSender.TLSA{name: {{Usage: 3, Selector: 1, MatchingType: 1, Data: []byte("wrong")}}}, true}, false},
+		{testTLSAResolver{map[string][]smtpSender.TLSA{name: {{Usage: 3, Selector: 1, MatchingType: 1, Data: []byte("wrong")}}}, false}, true},
+		// only PKIX-TA record is not usable, but TLS is required
+		{testTLSAResolver{map[string][]smtpSender.TLSA{name: {{Usage: 0, Selector: 1, MatchingType: 1, Data: []byte("wrong")}}}, true}, true},
+	}
+	for i, test := range tests {
+		var result smtpSender.Result
+		e := testTextEmail("dane", func(r smtpSender.Result) {
+			result = r
+		})
+		e.To = "recipient@mx.test"
+		conn := new(smtpSender.Connect)
+		conn.SetHostName("localtest")
+		conn.SetSMTPport(p)
+		conn.SetResolver(resolver)
+		conn.SetDANE(test.tlsa)
+		e.Send(conn, nil)
+
+		if test.delivered {
+			if result.Err != nil || result.TLSVersion == "" {
+				t.Errorf("test %d result: %v, TLS '%s'", i, result.Err, result.TLSVersion)
+			}
+			continue
+		}
+		var smtpErr *smtpSender.SMTPError
+		if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageDANE || !smtpErr.Temporary() {
+			t.Errorf("test %d result '%v', want temporary DANE error", i, result.Err)
+		}
+	}
+	if len(received) != 3 {
+		t.Errorf("server received %d emails, want 3", len(received))
+	}
+
+	// host with not usable TLSA records is not downgraded to plaintext
+	plainAddr, plainCloser := runserver(t, &smtpd.Server{}, received)
+	defer plainCloser()
+	_, plainPort, _ := net.SplitHostPort(plainAddr)
+	p, _ = strconv.Atoi(plainPort)
+	var result smtpSender.Result
+	e := testTextEmail("dane", func(r smtpSender.Result) {
+		result = r
+	})
+	e.To = "recipient@mx.test"
+	conn := new(smtpSender.Connect)
+	conn.SetHostName("localtest")
+	conn.SetSMTPport(p)
+	conn.SetResolver(resolver)
+	conn.SetDANE(testTLSAResolver{map[string][]smtpSender.TLSA{"_" + plainPort + "._tcp.mx1.mx.test": {{Usage: 1, Selector: 1, MatchingType: 1, Data: sum[:]}}}, true})
+	e.Send(conn, nil)
+	var smtpErr *smtpSender.SMTPError
+	if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageDANE || !smtpErr.Temporary() {
+		t.Errorf("plain server result '%v', want temporary DANE error", result.Err)
+	}
+	if len(received) != 3 {
+		t.Errorf("plain server received email")
+	}
+}
+
+// testFetcher return MTA-STS policies from map
+type testFetcher map[string]string
+
+func (f testFetcher) FetchPolicy(ctx context.Context, domain string) ([]byte, error) {
+	if policy, ok := f[domain]; ok {
+		return []byte(policy), nil
+	}
+	return nil, errors.New("404 Not Found")
+}
+
+func TestEmail_SendMTASTS(t *testing.T) {
+	received := make(chan receiveMail, 3)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	resolver := testResolver{
+		mx:   map[string][]*net.MX{},
+		host: map[string][]string{"mx1.mx.test.": {host}},
+		txt:  map[string][]string{},
+	}
+	fetcher := testFetcher{}
+	policies := map[string]string{
+		"enforce.test":  "version: STSv1\r\nmode: enforce\r\nmx: *.mx.test\r\nmax_age: 86400\r\n",
+		"mismatch.test": "version: STSv1\r\nmode: enforce\r\nmx: mx.other.test\r\nmax_age: 86400\r\n",
+		"testing.test":  "version: STSv1\r\nmode: testing\r\nmx: mx.other.test\r\nmax_age: 86400\r\n",
+		"nopolicy.test": "",
+	}
+	for domain, policy := range policies {
+		resolver.mx[domain] = []*net.MX{{Host: "mx1.mx.test.", Pref: 10}}
+		if policy != "" {
+			resolver.txt["_mta-sts."+domain] = []string{"v=STSv1; id=20200101T000000;"}
+			fetcher[domain] = policy
+		}
+	}
+	sts := smtpSender.NewMTASTS(fetcher)
+
+	tests := []struct {
+		domain    string
+		delivered bool
+		tlsErr    bool
+	}{
+		{"enforce.test", false, true},
+		{"mismatch.test", false, false},
+		{"testing.test", true, false},
+		{"nopolicy.test", true, false},
+	}
+	for _, test := range tests {
+		var result smtpSender.Result
+		e := smtpSender.NewBuilder().
+			SetFrom("Sender", "sender@localhost.localdomain").
+			SetTo("Recipient", "recipient@"+test.domain).
+			SetSubject("Test message").
+			AddTextPart([]byte(testText)).
+			Email(test.domain, func(r smtpSender.Result) {
+				result = r
+			})
+		conn := new(smtpSender.Connect)
+		conn.SetSMTPport(p)
+		conn.SetResolver(resolver)
+		conn.SetMTASTS(sts)
+		e.Send(conn, nil)
+
+		if test.delivered {
+			if result.Err != nil {
+				t.Errorf("domain %s result: %v", test.domain, result.Err)
+			}
+			continue
+		}
+		var smtpErr *smtpSender.SMTPError
+		if !errors.As(result.Err, &smtpErr) || smtpErr.Stage != smtpSender.StageMTASTS || !smtpErr.Temporary() {
+			t.Errorf("domain %s result '%v', want temporary MTA-STS error", test.domain, result.Err)
+		} else if (smtpErr.Err != nil) != test.tlsErr {
+			t.Errorf("domain %s MTA-STS error has TLS error '%v'", test.domain, smtpErr.Err)
+		}
+	}
+	if len(received) != 2 {
+		t.Errorf("server received %d emails, want 2", len(received))
+	}
+}
+
+func TestEmail_SendResolver(t *testing.T) {
+	received := make(chan receiveMail, 3)
+	addr, closer := runsslserver(t, &smtpd.Server{}, received)
+	defer closer()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	resolver := testResolver{
+		mx: map[string][]*net.MX{
+			"mx.test":   {{Host: "mx2.mx.test.", Pref: 20}, {Host: "mx1.mx.test.", Pref: 10}},
+			"null.test": {{Host: ".", Pref: 0}},
+			// unresolvable MX with lower preference is skipped
+			"dangling.test": {{Host: "dangling.mx.test.", Pref: 10}, {Host: "mx1.mx.test.", Pref: 20}},
+		},
+		host: map[string][]string{
+			"mx1.mx.test.":  {host},
+			"implicit.test": {host},
+		},
+	}
+	tests := []struct {
+		domain string
+		code   int
+	}{
+		{"mx.test", 0},
+		{"implicit.test", 0},
+		{"dangling.test", 0},
+		{"null.test", 556},
+		{"notexist.test", 550},
+	}
+	for _, test := range tests {
+		var result smtpSender.Result
+		e := smtpSender.NewBuilder().
+			SetFrom("Sender", "sender@localhost.localdomain").
+			SetTo("Recipient", "recipient@"+test.domain).
+			SetSubject("Test message").
+			AddTextPart([]byte(testText)).
+			Email(test.domain, func(r smtpSender.Result) {
+				result = r
+			})
+		conn := new(smtpSender.Connect)
+		conn.SetSMTPport(p)
+		conn.SetResolver(resolver)
+		e.Send(conn, nil)
+
+		if test.code == 0 {
+			if result.Err != nil {
+				t.Errorf("domain %s result: %v", test.domain, result.Err)
+			}
+			continue
+		}
+		var smtpErr *smtpSender.SMTPError
+		if !errors.As(result.Err, &smtpErr) || smtpErr.Code != test.code || smtpErr.Stage != smtpSender.StageLookup {
+			t.Errorf("domain %s result '%v', want %d lookup error", test.domain, result.Err, test.code)
+		}
+	}
+	if len(received) != 3 {
+		t.Errorf("server received %d emails, want 3", len(received))
+	}
+}
+
+func TestPipe_Shutdown(t *testing.T) {
+	addr, closer := runstallserver(t)
+	defer closer()
+
+	pipe := smtpSender.NewPipe(smtpSender.Config{
+		Hostname:   "localtest",
+		Stream:     1,
+		SMTPserver: testServer(t, addr),
+	})
+	if err := pipe.Start(); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan smtpSender.Result, 1)
+	e := testTextEmail("shutdown", func(r smtpSender.Result) {
+		results <- r
+	})
+	if err := pipe.SendContext(context.Background(), *e); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := pipe.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown return '%v'", err)
+	}
+	select {
+	case r := <-results:
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("result error '%v' is not context canceled", r.Err)
+		}
+	default:
+		t.Error("result not returned before shutdown")
+	}
+}
@@ -0,0 +1,204 @@
+package smtpSender
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolMessageExt  = ".eml"
+	spoolEnvelopeExt = ".json"
+)
+
+// Spool keep emails sent to Pipe in directory until final result,
+// after restart not delivered emails are resent from Pipe.Start.
+// Emails canceled by Pipe.Shutdown stay in spool without result.
+// Email may be delivered twice if process died after delivery but before result.
+type Spool struct {
+	dir string
+	seq uint64
+	// ResultFunc exec for emails recovered from spool, because their own result function is lost
+	ResultFunc func(Result)
+}
+
+// spoolEnvelope stored email fields
+type spoolEnvelope struct {
+	ID         string
+	From       string
+	To         string
+	Recipients []string
+	DontUseTLS bool
+	Transcript bool
+	DSN        *DSN
+	// Start first attempt time and Attempts done attempts, retry Lifetime continue after restart
+	Start    time.Time
+	Attempts int
+}
+
+// NewSpool return spool in dir, dir created if not exists
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// save rendered message and envelope, email will use saved message
+func (s *Spool) save(e *Email) error {
+	if e.WriteCloser == nil {
+		return fmt.Errorf("email id '%s' has not WriteCloser", e.ID)
+	}
+	name := fmt.Sprintf("%016x-%x", time.Now().UnixNano(), atomic.AddUint64(&s.seq, 1))
+	err := s.writeFile(name+spoolMessageExt, func(w io.Writer) error {
+		return e.WriteCloser(nopWriteCloser{w})
+	})
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(s.dir, name+spoolMessageExt)); err == nil {
+		e.Size = int(info.Size())
+	}
+	e.spool = name
+	if e.start.IsZero() {
+		e.start = time.Now()
+	}
+	if err = s.update(e); err != nil {
+		s.remove(name)
+		return err
+	}
+	s.use(e, e.ResultFunc)
+	return nil
+}
+
+// update saved envelope of email
+func (s *Spool) update(e *Email) error {
+	start, attempts := e.start, e.attempts
+	if e.retry != nil {
+		start, attempts = e.retry.start, e.retry.attempts
+	}
+	return s.writeFile(e.spool+spoolEnvelopeExt, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(spoolEnvelope{
+			ID:         e.ID,
+			From:       e.From,
+			To:         e.To,
+			Recipients: e.Recipients,
+			DontUseTLS: e.DontUseTLS,
+			Transcript: e.Transcript,
+			DSN:        e.DSN,
+			Start:      start,
+			Attempts:   attempts,
+		})
+	})
+}
+
+// use set email message from spool and remove it after result
+func (s *Spool) use(e *Email, resultFunc func(Result)) {
+	message := filepath.Join(s.dir, e.spool+spoolMessageExt)
+	name := e.spool
+	// saved message is already rendered
+	e.bodyWriter = nil
+	e.body = ""
+	e.WriteCloser = func(w io.WriteCloser) error {
+		f, err := os.Open(message)
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+		defer f.Close()
+		if _, err = io.Copy(w, f); err != nil {
+			_ = w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	e.ResultFunc = func(r Result) {
+		if resultFunc != nil {
+			resultFunc(r)
+		}
+		s.remove(name)
+	}
+}
+
+// remove saved email files
+func (s *Spool) remove(name string) {
+	_ = os.Remove(filepath.Join(s.dir, name+spoolEnvelopeExt))
+	_ = os.Remove(filepath.Join(s.dir, name+spoolMessageExt))
+}
+
+// recover return saved emails
+func (s *Spool) recover() ([]Email, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolEnvelopeExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var emails []Email
+	for i := range files {
+		name := strings.TrimSuffix(filepath.Base(files[i]), spoolEnvelopeExt)
+		info, err := os.Stat(filepath.Join(s.dir, name+spoolMessageExt))
+		if err != nil {
+			_ = os.Remove(files[i])
+			continue
+		}
+		data, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			return emails, err
+		}
+		var env spoolEnvelope
+		if err = json.Unmarshal(data, &env); err != nil {
+			return emails, fmt.Errorf("spool envelope '%s': %s", files[i], err)
+		}
+		e := Email{
+			ID:         env.ID,
+			From:       env.From,
+			To:         env.To,
+			Recipients: env.Recipients,
+			DontUseTLS: env.DontUseTLS,
+			Transcript: env.Transcript,
+			DSN:        env.DSN,
+			Size:       int(info.Size()),
+			spool:      name,
+			start:      env.Start,
+			attempts:   env.Attempts,
+		}
+		s.use(&e, s.ResultFunc)
+		emails = append(emails, e)
+	}
+	return emails, nil
+}
+
+// writeFile atomic write file in spool directory
+func (s *Spool) writeFile(name string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err = write(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,111 @@
+package smtpSender
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLookupTries = 3
+	defaultDialTries   = 5
+)
+
+// Timeouts for SMTP client, zero value use default.
+// Defaults are RFC 5321 4.5.3.2 recommended timeouts.
+type Timeouts struct {
+	// Dial TCP connect timeout. Default 60 seconds
+	Dial time.Duration
+	// DialRetry delay between dial tries. Default 5 seconds
+	DialRetry time.Duration
+	// Greeting wait for server 220 greeting. Default 5 minutes
+	Greeting time.Duration
+	// Command EHLO, STARTTLS, AUTH, RSET and QUIT reply. Default 5 minutes
+	Command time.Duration
+	// Mail MAIL FROM reply. Default 5 minutes
+	Mail time.Duration
+	// Rcpt RCPT TO reply. Default 5 minutes
+	Rcpt time.Duration
+	// DataInit DATA command reply. Default 2 minutes
+	DataInit time.Duration
+	// DataBlock send each data block. Default 3 minutes
+	DataBlock time.Duration
+	// DataTermination final dot reply. Default 10 minutes
+	DataTermination time.Duration
+}
+
+// withDefaults return timeouts with default values instead of zero
+func (t Timeouts) withDefaults() Timeouts {
+	set := func(d *time.Duration, def time.Duration) {
+		if *d <= 0 {
+			*d = def
+		}
+	}
+	set(&t.Dial, 60*time.Second)
+	set(&t.DialRetry, 5*time.Second)
+	set(&t.Greeting, 5*time.Minute)
+	set(&t.Command, 5*time.Minute)
+	set(&t.Mail, 5*time.Minute)
+	set(&t.Rcpt, 5*time.Minute)
+	set(&t.DataInit, 2*time.Minute)
+	set(&t.DataBlock, 3*time.Minute)
+	set(&t.DataTermination, 10*time.Minute)
+	return t
+}
+
+// timeoutConn connection with deadline for next command which can be interrupted by context
+type timeoutConn struct {
+	net.Conn
+	mu          sync.Mutex
+	interrupted bool
+	limit       *limit
+	closeOnce   sync.Once
+}
+
+// Close connection and release rate limit connection slot
+func (c *timeoutConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.limit.release)
+	return err
+}
+
+// timeout set deadline for next I/O, does nothing if connection was interrupted
+func (c *timeoutConn) timeout(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupted {
+		return nil
+	}
+	return c.Conn.SetDeadline(time.Now().Add(d))
+}
+
+// interrupt set deadline in the past for break current and all next I/O
+func (c *timeoutConn) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interrupted = true
+	_ = c.Conn.SetDeadline(time.Unix(1, 0))
+}
+
+// dataWriter refresh data block deadline on write and set final dot deadline on close
+type dataWriter struct {
+	io.WriteCloser
+	conn     *timeoutConn
+	timeouts Timeouts
+	last     time.Time
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	// builder writes by small parts, don't refresh deadline on every write
+	if now := time.Now(); now.Sub(w.last) > time.Second {
+		_ = w.conn.timeout(w.timeouts.DataBlock)
+		w.last = now
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func (w *dataWriter) Close() error {
+	_ = w.conn.timeout(w.timeouts.DataTermination)
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,79 @@
+package smtpSender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy STARTTLS usage policy
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic use STARTTLS if server support it, certificate is not verified.
+	// If TLS handshake failed then email is sent without TLS, but not with AUTH. Default
+	TLSOpportunistic TLSPolicy = iota
+	// TLSNone never use STARTTLS
+	TLSNone
+	// TLSRequire fail if server does not support STARTTLS, certificate is not verified
+	TLSRequire
+	// TLSRequireVerify fail if server does not support STARTTLS or certificate is not valid for server host name
+	TLSRequireVerify
+)
+
+// String return policy name
+func (p TLSPolicy) String() string {
+	switch p {
+	case TLSOpportunistic:
+		return "opportunistic"
+	case TLSNone:
+		return "none"
+	case TLSRequire:
+		return "require"
+	case TLSRequireVerify:
+		return "require-verify"
+	}
+	return "unknown"
+}
+
+// tlsVersionName return TLS version name like "TLS 1.3"
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// TLSOptions TLS settings for connect to server
+type TLSOptions struct {
+	// Policy STARTTLS usage policy. Default TLSOpportunistic
+	Policy TLSPolicy
+	// RootCAs for verify server certificate, nil use system roots
+	RootCAs *x509.CertPool
+	// MinVersion minimum TLS version, for example tls.VersionTLS12. Default crypto/tls default
+	MinVersion uint16
+	// Certificates client certificates for servers required TLS client authentication
+	Certificates []tls.Certificate
+	// Implicit TLS handshake before SMTP greeting (SMTPS) instead of STARTTLS, default port 465.
+	// Certificate is verified if Policy is TLSRequireVerify
+	Implicit bool
+}
+
+// config return tls.Config for server host name
+func (o TLSOptions) config(host string) *tls.Config {
+	return &tls.Config{
+		ServerName:         strings.TrimSuffix(host, "."),
+		InsecureSkipVerify: o.Policy != TLSRequireVerify,
+		RootCAs:            o.RootCAs,
+		MinVersion:         o.MinVersion,
+		Certificates:       o.Certificates,
+	}
+}
@@ -0,0 +1,67 @@
+package smtpSender
+
+import "time"
+
+// redacted replace AUTH credentials in transcript
+const redacted = "<redacted>"
+
+// TranscriptLine SMTP command or reply line, AUTH credentials and message body are not recorded
+type TranscriptLine struct {
+	Time time.Time
+	// Host SMTP server host
+	Host string
+	// Client true for client command, false for server reply
+	Client bool
+	Text   string
+}
+
+// String return line as "C: command" or "S: reply"
+func (l TranscriptLine) String() string {
+	if l.Client {
+		return "C: " + l.Text
+	}
+	return "S: " + l.Text
+}
+
+// TranscriptLogger receive SMTP conversation lines of email with id
+type TranscriptLogger interface {
+	Transcript(id string, line TranscriptLine)
+}
+
+// transcript records SMTP conversation of one email
+type transcript struct {
+	id     string
+	keep   bool
+	logger TranscriptLogger
+	lines  []TranscriptLine
+}
+
+// newTranscript return transcript kept for Result if keep and/or streamed to logger, nil if nothing to do
+func newTranscript(id string, keep bool, logger TranscriptLogger) *transcript {
+	if !keep && logger == nil {
+		return nil
+	}
+	return &transcript{id: id, keep: keep, logger: logger}
+}
+
+// add line to transcript
+func (t *transcript) add(host string, client bool, text string) {
+	if t == nil {
+		return
+	}
+	line := TranscriptLine{Time: time.Now(), Host: host, Client: client, Text: text}
+	if t.logger != nil {
+		t.logger.Transcript(t.id, line)
+	}
+	if t.keep {
+		t.lines = append(t.lines, line)
+	}
+}
+
+// result return recorded lines
+func (t *transcript) result() []TranscriptLine {
+	if t == nil {
+		return nil
+	}
+	return t.lines
+}